@@ -0,0 +1,465 @@
+package recommender
+
+import "fmt"
+
+type ProblemKind string
+
+const (
+	// MissingCounterpart is a rating recorded in only one of its two
+	// directions, e.g. in userLikes but not in itemLikes.
+	MissingCounterpart ProblemKind = "missing counterpart"
+	// ConflictingRating is a user-item pair that is both liked and disliked.
+	ConflictingRating ProblemKind = "conflicting rating"
+	// DanglingReference is an ID with no record in the user or item bucket.
+	DanglingReference ProblemKind = "dangling reference"
+	// StaleSimilarity is a similarity record that does not match the ratings.
+	StaleSimilarity ProblemKind = "stale similarity"
+	// StaleSuggestion is a suggestion for an item the user has rated or
+	// hidden, or for an item that does not exist, or a user's suggestions
+	// marked stale.
+	StaleSuggestion ProblemKind = "stale suggestion"
+)
+
+// Problem describes a single inconsistency found in the database.
+type Problem struct {
+	Kind   ProblemKind `json:"kind"`
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	Detail string      `json:"detail"`
+}
+
+// String represents a Problem as a string
+func (p Problem) String() string {
+	return fmt.Sprintf("%s in %s[%s]: %s", p.Kind, p.Bucket, p.Key, p.Detail)
+}
+
+// Report lists the problems found by Check, or fixed by Repair.
+type Report struct {
+	Problems []Problem `json:"problems"`
+}
+
+// OK reports whether no problems were found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) add(kind ProblemKind, bucket, key, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{
+		Kind:   kind,
+		Bucket: bucket,
+		Key:    key,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// snapshot holds the contents of every bucket Check inspects.
+type snapshot struct {
+	users, items                   map[string]bool
+	userLikes, itemLikes           map[string]map[string]bool
+	userDislikes, itemDislikes     map[string]map[string]bool
+	userSimilarity, itemSimilarity map[string]map[string]similarityRecord
+	suggestions, hidden            map[string]map[string]bool
+	staleSuggestions               map[string]bool
+}
+
+// loadSnapshot reads every bucket Check inspects within the given transaction.
+func (r *Recommender) loadSnapshot(tx namespace) (*snapshot, error) {
+	s := &snapshot{
+		users:            make(map[string]bool),
+		items:            make(map[string]bool),
+		userLikes:        make(map[string]map[string]bool),
+		itemLikes:        make(map[string]map[string]bool),
+		userDislikes:     make(map[string]map[string]bool),
+		itemDislikes:     make(map[string]map[string]bool),
+		userSimilarity:   make(map[string]map[string]similarityRecord),
+		itemSimilarity:   make(map[string]map[string]similarityRecord),
+		suggestions:      make(map[string]map[string]bool),
+		hidden:           make(map[string]map[string]bool),
+		staleSuggestions: make(map[string]bool),
+	}
+
+	for bucketName, ids := range map[string]map[string]bool{
+		userBucketName:             s.users,
+		itemBucketName:             s.items,
+		staleSuggestionsBucketName: s.staleSuggestions,
+	} {
+		if err := tx.Bucket([]byte(bucketName)).ForEach(func(key, _ []byte) error {
+			ids[string(key)] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Suggestions and hidden items are only checked for the items they
+	// refer to
+	for bucketName, sets := range map[string]map[string]map[string]bool{
+		userLikesBucketName:    s.userLikes,
+		itemLikesBucketName:    s.itemLikes,
+		userDislikesBucketName: s.userDislikes,
+		itemDislikesBucketName: s.itemDislikes,
+		suggestionBucketName:   s.suggestions,
+		hiddenBucketName:       s.hidden,
+	} {
+		if err := tx.Bucket([]byte(bucketName)).ForEach(func(key, _ []byte) error {
+			sets[string(key)] = setMembers(tx, bucketName, string(key))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for bucketName, similarity := range map[string]map[string]map[string]similarityRecord{
+		userSimilarityBucketName: s.userSimilarity,
+		itemSimilarityBucketName: s.itemSimilarity,
+	} {
+		if err := tx.Bucket([]byte(bucketName)).ForEach(func(key, _ []byte) error {
+			records, err := r.getRecords(tx, bucketName, string(key))
+			if err != nil {
+				return err
+			}
+			similarity[string(key)] = records
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// ratings returns the ratings the snapshot should hold, keyed by user ID and
+// then item ID. The user side of each rating is authoritative: pairs that are
+// both liked and disliked, and pairs referring to missing users or items, are
+// left out.
+func (s *snapshot) ratings() map[string]map[string]Score {
+	ratings := make(map[string]map[string]Score)
+	for userId, itemIds := range s.userLikes {
+		for itemId := range itemIds {
+			if s.users[userId] && s.items[itemId] && !s.userDislikes[userId][itemId] {
+				if ratings[userId] == nil {
+					ratings[userId] = make(map[string]Score)
+				}
+				ratings[userId][itemId] = like
+			}
+		}
+	}
+	for userId, itemIds := range s.userDislikes {
+		for itemId := range itemIds {
+			if s.users[userId] && s.items[itemId] && !s.userLikes[userId][itemId] {
+				if ratings[userId] == nil {
+					ratings[userId] = make(map[string]Score)
+				}
+				ratings[userId][itemId] = dislike
+			}
+		}
+	}
+	return ratings
+}
+
+// expectedSimilarity computes the user and item similarity records that
+// follow from the given ratings.
+func expectedSimilarity(ratings map[string]map[string]Score) (users, items map[string]map[string]similarityRecord) {
+	users = make(map[string]map[string]similarityRecord)
+	items = make(map[string]map[string]similarityRecord)
+
+	tally := func(records map[string]map[string]similarityRecord, id1, id2 string, score1, score2 Score) {
+		if records[id1] == nil {
+			records[id1] = make(map[string]similarityRecord)
+		}
+		records[id1][id2] = records[id1][id2].count(score1, score2, 1)
+	}
+
+	// Item pairs share a rater
+	raters := make(map[string]map[string]Score)
+	for userId, scores := range ratings {
+		for itemId1, score1 := range scores {
+			if raters[itemId1] == nil {
+				raters[itemId1] = make(map[string]Score)
+			}
+			raters[itemId1][userId] = score1
+			for itemId2, score2 := range scores {
+				if itemId1 != itemId2 {
+					tally(items, itemId1, itemId2, score1, score2)
+				}
+			}
+		}
+	}
+
+	// User pairs share a rated item
+	for _, scores := range raters {
+		for userId1, score1 := range scores {
+			for userId2, score2 := range scores {
+				if userId1 != userId2 {
+					tally(users, userId1, userId2, score1, score2)
+				}
+			}
+		}
+	}
+
+	return users, items
+}
+
+// check appends every problem found in the snapshot to the report.
+func (s *snapshot) check(report *Report) {
+	// Both directions of every rating agree
+	checkMirror := func(forward, backward map[string]map[string]bool, forwardName, backwardName string) {
+		for key, ids := range forward {
+			for id := range ids {
+				if !backward[id][key] {
+					report.add(MissingCounterpart, backwardName, id, "%s[%s] contains %s, but %s[%s] does not contain %s", forwardName, key, id, backwardName, id, key)
+				}
+			}
+		}
+	}
+	checkMirror(s.userLikes, s.itemLikes, userLikesBucketName, itemLikesBucketName)
+	checkMirror(s.itemLikes, s.userLikes, itemLikesBucketName, userLikesBucketName)
+	checkMirror(s.userDislikes, s.itemDislikes, userDislikesBucketName, itemDislikesBucketName)
+	checkMirror(s.itemDislikes, s.userDislikes, itemDislikesBucketName, userDislikesBucketName)
+
+	// No pair is both liked and disliked
+	checkConflicts := func(likes, dislikes map[string]map[string]bool, likesName, dislikesName string) {
+		for key, ids := range likes {
+			for id := range ids {
+				if dislikes[key][id] {
+					report.add(ConflictingRating, dislikesName, key, "%s is in both %s[%s] and %s[%s]", id, likesName, key, dislikesName, key)
+				}
+			}
+		}
+	}
+	checkConflicts(s.userLikes, s.userDislikes, userLikesBucketName, userDislikesBucketName)
+	checkConflicts(s.itemLikes, s.itemDislikes, itemLikesBucketName, itemDislikesBucketName)
+
+	// Every referenced ID exists
+	checkReferences := func(sets map[string]map[string]bool, bucketName string, keys, members map[string]bool, keyKind, memberKind string) {
+		for key, ids := range sets {
+			if !keys[key] {
+				report.add(DanglingReference, bucketName, key, "%s %s does not exist", keyKind, key)
+			}
+			for id := range ids {
+				if !members[id] {
+					report.add(DanglingReference, bucketName, key, "%s %s does not exist", memberKind, id)
+				}
+			}
+		}
+	}
+	checkReferences(s.userLikes, userLikesBucketName, s.users, s.items, "user", "item")
+	checkReferences(s.userDislikes, userDislikesBucketName, s.users, s.items, "user", "item")
+	checkReferences(s.itemLikes, itemLikesBucketName, s.items, s.users, "item", "user")
+	checkReferences(s.itemDislikes, itemDislikesBucketName, s.items, s.users, "item", "user")
+
+	// Similarity records match the ratings
+	ratings := s.ratings()
+	expectedUsers, expectedItems := expectedSimilarity(ratings)
+	checkSimilarity := func(stored, expected map[string]map[string]similarityRecord, bucketName string) {
+		for key, records := range stored {
+			for id, record := range records {
+				if want := expected[key][id]; record != want {
+					report.add(StaleSimilarity, bucketName, key, "record for %s is %+v, should be %+v", id, record, want)
+				}
+			}
+		}
+		for key, records := range expected {
+			for id, want := range records {
+				if _, exists := stored[key][id]; !exists {
+					report.add(StaleSimilarity, bucketName, key, "record for %s is missing, should be %+v", id, want)
+				}
+			}
+		}
+	}
+	checkSimilarity(s.userSimilarity, expectedUsers, userSimilarityBucketName)
+	checkSimilarity(s.itemSimilarity, expectedItems, itemSimilarityBucketName)
+
+	// Suggestions refer to existing items the user has not rated
+	for userId, itemIds := range s.suggestions {
+		if !s.users[userId] {
+			report.add(DanglingReference, suggestionBucketName, userId, "user %s does not exist", userId)
+		}
+		for itemId := range itemIds {
+			if !s.items[itemId] {
+				report.add(StaleSuggestion, suggestionBucketName, userId, "item %s does not exist", itemId)
+			} else if _, rated := ratings[userId][itemId]; rated {
+				report.add(StaleSuggestion, suggestionBucketName, userId, "item %s is already rated", itemId)
+			} else if s.hidden[userId][itemId] {
+				report.add(StaleSuggestion, suggestionBucketName, userId, "item %s is hidden", itemId)
+			}
+		}
+	}
+	for userId := range s.staleSuggestions {
+		report.add(StaleSuggestion, staleSuggestionsBucketName, userId, "suggestions are marked stale")
+	}
+}
+
+// Check verifies that both directions of every rating agree, that no pair is
+// both liked and disliked, that every referenced user and item exists, and
+// that similarity records and suggestions are not stale. The database is not
+// modified.
+func (r *Recommender) Check() (*Report, error) {
+	report := &Report{}
+
+	if err := r.view(func(tx namespace) error {
+		s, err := r.loadSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		s.check(report)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Repair fixes every problem Check would report and returns the problems it
+// found. The user side of each rating is taken as authoritative: the item
+// side is rebuilt from it, pairs that are both liked and disliked are
+// dropped, and references to missing users or items are removed. Dropped
+// ratings are logged as removed. Similarity records are then recomputed, and
+// so are the suggestions of every user.
+// To take the rating log as authoritative instead, use ReplayRatingLog.
+func (r *Recommender) Repair() (*Report, error) {
+	report := &Report{}
+	var userIds []string
+
+	if err := r.update(func(tx namespace) error {
+		s, err := r.loadSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		s.check(report)
+		if report.OK() {
+			return nil
+		}
+
+		// Log the removal of user-side ratings that are dropped
+		ratings := s.ratings()
+		dropped := make(map[[2]string]bool)
+		for _, userSets := range []map[string]map[string]bool{s.userLikes, s.userDislikes} {
+			for userId, itemIds := range userSets {
+				for itemId := range itemIds {
+					if _, kept := ratings[userId][itemId]; kept || dropped[[2]string{userId, itemId}] {
+						continue
+					}
+					dropped[[2]string{userId, itemId}] = true
+					if err := logRating(tx, r.codec, RatingEvent{UserId: userId, ItemId: itemId, Time: r.clock()}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		// Rebuild both directions of every rating and the similarity
+		// records that follow from them
+		if err := r.writeRatings(tx, ratings); err != nil {
+			return err
+		}
+
+		// Drop suggestions of missing users; the rest are recomputed below
+		for userId := range s.suggestions {
+			if !s.users[userId] {
+				if err := deleteAllNested(tx, suggestionBucketName, userId); err != nil {
+					return err
+				}
+			}
+		}
+		for userId := range s.staleSuggestions {
+			if !s.users[userId] {
+				if err := tx.Bucket([]byte(staleSuggestionsBucketName)).Delete([]byte(userId)); err != nil {
+					return err
+				}
+			}
+		}
+		for userId := range s.users {
+			userIds = append(userIds, userId)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, userId := range userIds {
+		if err := r.UpdateSuggestions(&User{Id: userId}); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// writeRatings replaces the like and dislike sets with the given ratings, in
+// both directions, and recomputes the similarity records that follow from
+// them.
+func (r *Recommender) writeRatings(tx namespace, ratings map[string]map[string]Score) error {
+	// Rebuild both directions of every rating
+	sets := map[string]map[string]map[string][]byte{
+		userLikesBucketName:    make(map[string]map[string][]byte),
+		itemLikesBucketName:    make(map[string]map[string][]byte),
+		userDislikesBucketName: make(map[string]map[string][]byte),
+		itemDislikesBucketName: make(map[string]map[string][]byte),
+	}
+	add := func(bucketName, key, id string) {
+		if sets[bucketName][key] == nil {
+			sets[bucketName][key] = make(map[string][]byte)
+		}
+		sets[bucketName][key][id] = []byte{}
+	}
+	for userId, scores := range ratings {
+		for itemId, score := range scores {
+			if score == like {
+				add(userLikesBucketName, userId, itemId)
+				add(itemLikesBucketName, itemId, userId)
+			} else {
+				add(userDislikesBucketName, userId, itemId)
+				add(itemDislikesBucketName, itemId, userId)
+			}
+		}
+	}
+	for bucketName, values := range sets {
+		if err := replaceBucket(tx, bucketName, values); err != nil {
+			return err
+		}
+	}
+
+	// Recompute similarity records
+	expectedUsers, expectedItems := expectedSimilarity(ratings)
+	for bucketName, values := range map[string]map[string]map[string]similarityRecord{
+		userSimilarityBucketName: expectedUsers,
+		itemSimilarityBucketName: expectedItems,
+	} {
+		encoded := make(map[string]map[string][]byte)
+		for key, records := range values {
+			encoded[key] = make(map[string][]byte)
+			for id, record := range records {
+				data, err := r.codec.Marshal(record)
+				if err != nil {
+					return err
+				}
+				encoded[key][id] = data
+			}
+		}
+		if err := replaceBucket(tx, bucketName, encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceBucket replaces the contents of the named bucket with one nested
+// bucket per key, holding the given values.
+func replaceBucket(tx namespace, bucketName string, values map[string]map[string][]byte) error {
+	if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket([]byte(bucketName)); err != nil {
+		return err
+	}
+	for key, entries := range values {
+		for member, value := range entries {
+			if err := putNested(tx, bucketName, key, member, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Command recommender checks, repairs and exports a recommender database.
+//
+// Usage:
+//
+//	recommender [-db path] [-tenant name] check
+//	recommender [-db path] [-tenant name] repair
+//	recommender [-db path] [-tenant name] export
+//
+// check reports every inconsistency it finds and exits with status 1 if there
+// are any. repair fixes them and reports what it fixed. export writes the
+// tenant's data to standard output as JSON. Without -tenant, the default
+// tenant is used. check and export open the file read-only, so they change
+// nothing, not even stale suggestions; repair upgrades the file first.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nikovacevic/recommender"
+)
+
+func main() {
+	path := flag.String("db", "recommender.db", "path of the database file")
+	tenant := flag.String("tenant", "", "name of the tenant, if not the default one")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-db path] [-tenant name] check|repair|export\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []recommender.Option{recommender.WithPath(*path)}
+	switch flag.Arg(0) {
+	case "check", "export":
+		opts = append(opts, recommender.WithReadOnly())
+	case "repair":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	root, err := recommender.NewRecommender(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer root.Close()
+	r := root
+	if *tenant != "" {
+		tenants, err := root.Tenants()
+		if err != nil {
+			log.Fatal(err)
+		}
+		found := false
+		for _, name := range tenants {
+			found = found || name == *tenant
+		}
+		if !found {
+			log.Fatalf("no tenant %q", *tenant)
+		}
+		if r, err = root.Tenant(*tenant); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var report *recommender.Report
+	switch flag.Arg(0) {
+	case "check":
+		report, err = r.Check()
+	case "repair":
+		report, err = r.Repair()
+	case "export":
+		if err := r.Export(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	if flag.Arg(0) == "repair" {
+		fmt.Printf("%d problems repaired\n", len(report.Problems))
+		return
+	}
+	fmt.Printf("%d problems found\n", len(report.Problems))
+	if !report.OK() {
+		root.Close()
+		os.Exit(1)
+	}
+}
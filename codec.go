@@ -0,0 +1,547 @@
+package recommender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Codec encodes the values stored in the database: *User, *Item,
+// *RatingEvent, *Rule, similarity and impression records, *SuggestionIndex
+// and implicit preference strengths as *float32. The name of the codec a file
+// was written with is recorded in its metadata, so it must be unique and must
+// not change.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec stores values as JSON, which is easy to inspect.
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec stores values in a compact binary form, with packed UUIDs,
+	// varint counts and float32 scores. New files use it by default.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// codecs are the codecs a recorded name can be resolved to without WithCodec.
+var codecs = map[string]Codec{
+	JSONCodec.Name():   JSONCodec,
+	BinaryCodec.Name(): BinaryCodec,
+}
+
+var codecKey = []byte("codec")
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch v := v.(type) {
+	case *User:
+		writeID(&buf, v.Id)
+		writeString(&buf, v.Name)
+		ids := make([]string, 0, len(v.Ratings))
+		for id := range v.Ratings {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		writeUvarint(&buf, uint64(len(ids)))
+		for _, id := range ids {
+			rating := v.Ratings[id]
+			writeID(&buf, id)
+			writeItem(&buf, &rating.Item)
+			writeVarint(&buf, int64(rating.Score))
+		}
+		writeString(&buf, v.ExternalId)
+	case *Item:
+		writeItem(&buf, v)
+		writeItemDetails(&buf, v)
+	case *RatingEvent:
+		writeID(&buf, v.UserId)
+		writeID(&buf, v.ItemId)
+		writeVarint(&buf, int64(v.Score))
+		writeTime(&buf, v.Time)
+	case similarityRecord:
+		writeVarint(&buf, int64(v.Agree))
+		writeVarint(&buf, int64(v.Disagree))
+	case *similarityRecord:
+		writeVarint(&buf, int64(v.Agree))
+		writeVarint(&buf, int64(v.Disagree))
+	case *Rule:
+		writeID(&buf, v.Id)
+		writeString(&buf, string(v.Kind))
+		writeID(&buf, v.Match.ItemId)
+		writeString(&buf, v.Match.Attribute)
+		writeString(&buf, v.Match.Value)
+		writeBool(&buf, v.Match.Negate)
+		writeVarint(&buf, int64(v.Position))
+		writeFloat32(&buf, float32(v.Amount))
+		writeString(&buf, v.Attribute)
+		writeVarint(&buf, int64(v.Limit))
+	case impressionRecord:
+		writeImpressions(&buf, &v)
+	case *impressionRecord:
+		writeImpressions(&buf, v)
+	case float32:
+		writeFloat32(&buf, v)
+	case *float32:
+		writeFloat32(&buf, *v)
+	case SuggestionIndex:
+		writeFloat32(&buf, float32(v))
+	case *SuggestionIndex:
+		writeFloat32(&buf, float32(*v))
+	default:
+		return nil, fmt.Errorf("binary codec cannot encode %T", v)
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	r := &binaryReader{data: data}
+	switch v := v.(type) {
+	case *User:
+		v.Id = r.id()
+		v.Name = r.string()
+		v.Ratings = nil
+		if n := r.uvarint(); n > 0 && r.err == nil {
+			v.Ratings = make(map[string]Rating, n)
+			for i := uint64(0); i < n && r.err == nil; i++ {
+				id := r.id()
+				var rating Rating
+				r.item(&rating.Item)
+				rating.Score = Score(r.varint())
+				v.Ratings[id] = rating
+			}
+		}
+		// Users written before external IDs end here
+		v.ExternalId = ""
+		if len(r.data) > 0 {
+			v.ExternalId = r.string()
+		}
+	case *Item:
+		r.item(v)
+		r.itemDetails(v)
+	case *RatingEvent:
+		v.UserId = r.id()
+		v.ItemId = r.id()
+		v.Score = Score(r.varint())
+		v.Time = r.time()
+	case *similarityRecord:
+		v.Agree = int(r.varint())
+		v.Disagree = int(r.varint())
+	case *Rule:
+		v.Id = r.id()
+		v.Kind = RuleKind(r.string())
+		v.Match.ItemId = r.id()
+		v.Match.Attribute = r.string()
+		v.Match.Value = r.string()
+		v.Match.Negate = r.bool()
+		v.Position = int(r.varint())
+		v.Amount = SuggestionIndex(r.float32())
+		v.Attribute = r.string()
+		v.Limit = int(r.varint())
+	case *impressionRecord:
+		v.Shown = int(r.uvarint())
+		v.Clicked = int(r.uvarint())
+		v.Ignored = int(r.uvarint())
+	case *float32:
+		*v = r.float32()
+	case *SuggestionIndex:
+		*v = SuggestionIndex(r.float32())
+	default:
+		return fmt.Errorf("binary codec cannot decode %T", v)
+	}
+	return r.err
+}
+
+// IDs are written with a leading kind byte, so that IDs which are not UUIDs
+// can still be stored.
+const (
+	idUUID   byte = 0
+	idString byte = 1
+)
+
+func writeID(buf *bytes.Buffer, id string) {
+	if u, err := uuid.FromString(id); err == nil && u.String() == id {
+		buf.WriteByte(idUUID)
+		buf.Write(u.Bytes())
+		return
+	}
+	buf.WriteByte(idString)
+	writeString(buf, id)
+}
+
+func writeItem(buf *bytes.Buffer, item *Item) {
+	writeID(buf, item.Id)
+	writeString(buf, item.Name)
+	keys := make([]string, 0, len(item.Attributes))
+	for key := range item.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		writeString(buf, key)
+		writeString(buf, item.Attributes[key])
+	}
+}
+
+// writeItemDetails writes whether an item is inactive, when it is available
+// and its external ID. They follow stored items only, not the copies held in
+// ratings, and items written before they existed simply end without them.
+func writeItemDetails(buf *bytes.Buffer, item *Item) {
+	writeBool(buf, item.Inactive)
+	writeTime(buf, item.AvailableFrom)
+	writeTime(buf, item.AvailableUntil)
+	writeString(buf, item.ExternalId)
+}
+
+func writeImpressions(buf *bytes.Buffer, record *impressionRecord) {
+	writeUvarint(buf, uint64(record.Shown))
+	writeUvarint(buf, uint64(record.Clicked))
+	writeUvarint(buf, uint64(record.Ignored))
+}
+
+func writeBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+}
+
+func writeVarint(buf *bytes.Buffer, n int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutVarint(scratch[:], n)])
+}
+
+// writeTime writes t as seconds since the epoch and nanoseconds. The zero
+// time is kept distinct, since it marks events of unknown time.
+func writeTime(buf *bytes.Buffer, t time.Time) {
+	if t.IsZero() {
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteByte(1)
+	writeVarint(buf, t.Unix())
+	writeUvarint(buf, uint64(t.Nanosecond()))
+}
+
+func writeFloat32(buf *bytes.Buffer, f float32) {
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], math.Float32bits(f))
+	buf.Write(scratch[:])
+}
+
+var errShortValue = errors.New("binary codec: value is truncated")
+
+// binaryReader decodes values written by binaryCodec. The first error is
+// kept in err, after which every read returns a zero value.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = errShortValue
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) id() string {
+	kind := r.next(1)
+	if kind == nil {
+		return ""
+	}
+	if kind[0] == idString {
+		return r.string()
+	}
+	u, err := uuid.FromBytes(r.next(16))
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	if r.err != nil {
+		return ""
+	}
+	return u.String()
+}
+
+func (r *binaryReader) item(item *Item) {
+	item.Id = r.id()
+	item.Name = r.string()
+	item.Attributes = nil
+	if n := r.uvarint(); n > 0 && r.err == nil {
+		item.Attributes = make(map[string]string, n)
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			key := r.string()
+			item.Attributes[key] = r.string()
+		}
+	}
+}
+
+// itemDetails reads what writeItemDetails wrote, as far as it goes.
+func (r *binaryReader) itemDetails(item *Item) {
+	item.Inactive = false
+	item.AvailableFrom = time.Time{}
+	item.AvailableUntil = time.Time{}
+	item.ExternalId = ""
+	if r.err != nil || len(r.data) == 0 {
+		return
+	}
+	item.Inactive = r.bool()
+	item.AvailableFrom = r.time()
+	item.AvailableUntil = r.time()
+	if len(r.data) > 0 {
+		item.ExternalId = r.string()
+	}
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		if r.err == nil {
+			r.err = errShortValue
+		}
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 {
+		r.err = errShortValue
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(r.data)
+	if size <= 0 {
+		r.err = errShortValue
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *binaryReader) time() time.Time {
+	kind := r.next(1)
+	if kind == nil || kind[0] == 0 {
+		return time.Time{}
+	}
+	sec := r.varint()
+	nsec := r.uvarint()
+	if r.err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+func (r *binaryReader) bool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *binaryReader) float32() float32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return math.Float32frombits(binary.BigEndian.Uint32(b))
+}
+
+// getCodecName reads the name of the codec recorded in the meta bucket, or ""
+// if there is none.
+func getCodecName(tx *bolt.Tx) string {
+	metaBucket := tx.Bucket([]byte(metaBucketName))
+	if metaBucket == nil {
+		return ""
+	}
+	return string(metaBucket.Get(codecKey))
+}
+
+// putCodecName records the name of the codec in the meta bucket.
+func putCodecName(tx *bolt.Tx, name string) error {
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	return metaBucket.Put(codecKey, []byte(name))
+}
+
+// recordJSONCodec records that a file from before codecs were recorded holds
+// JSON values.
+func recordJSONCodec(tx *bolt.Tx) error {
+	return putCodecName(tx, JSONCodec.Name())
+}
+
+// openCodec settles which codec the Recommender uses. Without WithCodec, the
+// codec recorded in the file is used, or BinaryCodec for a new file. If
+// WithCodec names a different codec from the recorded one, every stored value
+// of every tenant is re-encoded in a single transaction.
+func (r *Recommender) openCodec() error {
+	return r.logStorageError(storageError(r.db.Update(func(tx *bolt.Tx) error {
+		name := getCodecName(tx)
+		if name == "" {
+			if r.codec == nil {
+				r.codec = BinaryCodec
+			}
+			return putCodecName(tx, r.codec.Name())
+		}
+		if r.codec == nil {
+			codec, exists := codecs[name]
+			if !exists {
+				return fmt.Errorf("database is encoded with unknown codec %q", name)
+			}
+			r.codec = codec
+			return nil
+		}
+		if r.codec.Name() == name {
+			return nil
+		}
+		from, exists := codecs[name]
+		if !exists {
+			return fmt.Errorf("database is encoded with unknown codec %q", name)
+		}
+		// Every tenant shares the codec of the file
+		if err := transcode(tx, from, r.codec); err != nil {
+			return err
+		}
+		tenants := tx.Bucket([]byte(tenantBucketName))
+		if err := tenants.ForEach(func(name, _ []byte) error {
+			return transcode(tenants.Bucket(name), from, r.codec)
+		}); err != nil {
+			return err
+		}
+		return putCodecName(tx, r.codec.Name())
+	})))
+}
+
+// transcode re-encodes every stored value from one codec to another. ID sets
+// hold no values and are left alone.
+func transcode(tx namespace, from, to Codec) error {
+	recode := func(data []byte, v interface{}) ([]byte, error) {
+		if err := from.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return to.Marshal(v)
+	}
+
+	// Users, items, rating events, item impression totals and rules are
+	// stored directly in their buckets
+	for bucketName, newValue := range map[string]func() interface{}{
+		userBucketName:           func() interface{} { return &User{} },
+		itemBucketName:           func() interface{} { return &Item{} },
+		ratingLogBucketName:      func() interface{} { return &RatingEvent{} },
+		itemImpressionBucketName: func() interface{} { return &impressionRecord{} },
+		ruleBucketName:           func() interface{} { return &Rule{} },
+	} {
+		if err := recodeBucket(tx.Bucket([]byte(bucketName)), func(data []byte) ([]byte, error) {
+			return recode(data, newValue())
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Similarity records, suggestions, implicit preference strengths and
+	// impressions are stored in nested buckets
+	for bucketName, newValue := range map[string]func() interface{}{
+		userSimilarityBucketName: func() interface{} { return &similarityRecord{} },
+		itemSimilarityBucketName: func() interface{} { return &similarityRecord{} },
+		suggestionBucketName:     func() interface{} { return new(SuggestionIndex) },
+		userImplicitBucketName:   func() interface{} { return new(float32) },
+		itemImplicitBucketName:   func() interface{} { return new(float32) },
+		impressionBucketName:     func() interface{} { return &impressionRecord{} },
+	} {
+		bucket := tx.Bucket([]byte(bucketName))
+		if err := bucket.ForEach(func(key, _ []byte) error {
+			return recodeBucket(bucket.Bucket(key), func(data []byte) ([]byte, error) {
+				return recode(data, newValue())
+			})
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recodeBucket replaces every value in the bucket with the result of recode.
+// Nested buckets are skipped.
+func recodeBucket(bucket *bolt.Bucket, recode func([]byte) ([]byte, error)) error {
+	if bucket == nil {
+		return nil
+	}
+	values := make(map[string][]byte)
+	if err := bucket.ForEach(func(key, val []byte) error {
+		if val == nil {
+			return nil
+		}
+		data, err := recode(val)
+		if err != nil {
+			return err
+		}
+		values[string(key)] = data
+		return nil
+	}); err != nil {
+		return err
+	}
+	for key, data := range values {
+		if err := bucket.Put([]byte(key), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
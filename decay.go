@@ -0,0 +1,112 @@
+package recommender
+
+import (
+	"math"
+	"time"
+)
+
+// DecayBasis selects which age a rating's decay is measured by.
+type DecayBasis int
+
+const (
+	// RatingAge decays a rating by the time since it was last changed.
+	RatingAge DecayBasis = iota
+	// ItemAge decays a rating by the time since its item was first rated.
+	ItemAge
+)
+
+// Decay weights ratings so that older ones count less in user similarity,
+// suggestions and predictions. A rating's weight halves with every HalfLife
+// of age. Ratings of unknown age, such as those made before ratings were
+// timestamped, are not decayed. The zero value disables decay.
+type Decay struct {
+	HalfLife time.Duration
+	By       DecayBasis
+}
+
+// enabled reports whether the decay weights anything.
+func (d Decay) enabled() bool {
+	return d.HalfLife > 0
+}
+
+// weight returns the weight of a rating made, or of an item first rated, at
+// time t.
+func (d Decay) weight(t, now time.Time) float32 {
+	if !d.enabled() || t.IsZero() || !now.After(t) {
+		return 1
+	}
+	return float32(math.Exp2(-float64(now.Sub(t)) / float64(d.HalfLife)))
+}
+
+// decayWeights returns the weight of the user's rating of each item in scores.
+// Without decay, every weight is 1.
+func (r *Recommender) decayWeights(tx namespace, userId string, scores map[string]Score, now time.Time) (map[string]float32, error) {
+	weights := make(map[string]float32, len(scores))
+	if !r.decay.enabled() {
+		for itemId := range scores {
+			weights[itemId] = 1
+		}
+		return weights, nil
+	}
+
+	var times map[string]time.Time
+	if r.decay.By == RatingAge {
+		var err error
+		if times, err = r.ratingTimes(tx, userId); err != nil {
+			return nil, err
+		}
+	}
+	for itemId := range scores {
+		if r.decay.By == ItemAge {
+			weights[itemId] = r.decay.weight(firstRated(tx, itemId), now)
+		} else {
+			weights[itemId] = r.decay.weight(times[itemId], now)
+		}
+	}
+	return weights, nil
+}
+
+// firstRated returns when the item was first rated, according to the rating
+// log, or the zero time if that is unknown.
+func firstRated(tx namespace, itemId string) time.Time {
+	indexBucket := nestedBucket(tx, itemRatingLogBucketName, itemId)
+	if indexBucket == nil {
+		return time.Time{}
+	}
+	indexKey, _ := indexBucket.Cursor().First()
+	if indexKey == nil {
+		return time.Time{}
+	}
+	return timeFromKey(indexKey[:12])
+}
+
+// pairSimilarity is the similarity of two users, as read from a stored record
+// or computed from weighted preferences.
+type pairSimilarity struct {
+	index   SimilarityIndex
+	overlap int
+}
+
+// weightedIndex returns the similarity of two users with each co-rated item
+// counted by the product of the two scores' weights.
+func weightedIndex(scores1, scores2 map[string]Score, weights1, weights2 map[string]float32) pairSimilarity {
+	var agree, disagree float32
+	var overlap int
+	for itemId, score1 := range scores1 {
+		score2, exists := scores2[itemId]
+		if !exists {
+			continue
+		}
+		overlap++
+		weight := weights1[itemId] * weights2[itemId]
+		if score1 == score2 {
+			agree += weight
+		} else {
+			disagree += weight
+		}
+	}
+	if agree+disagree == 0 {
+		return pairSimilarity{overlap: overlap}
+	}
+	return pairSimilarity{SimilarityIndex((agree - disagree) / (agree + disagree)), overlap}
+}
@@ -0,0 +1,197 @@
+package recommender
+
+import (
+	"sort"
+	"time"
+)
+
+// Diversity controls how GetTopSuggestions trades relevance for variety. The
+// zero value ranks by suggestion index alone.
+type Diversity struct {
+	// Tradeoff weighs diversity against relevance, from 0 (relevance only)
+	// to 1 (diversity only).
+	Tradeoff float32
+}
+
+// SuggestionList is a ranked list of suggestions.
+type SuggestionList struct {
+	Suggestions []Suggestion `json:"suggestions"`
+	// Diversity is the intra-list diversity: the mean dissimilarity of every
+	// pair of suggestions, from 0 (all alike) to 1 (nothing in common).
+	Diversity float32 `json:"diversity"`
+}
+
+// GetTopSuggestions returns up to n of the user's suggestions, re-ranked by
+// maximal marginal relevance: each next suggestion is the one that best
+// balances its index against its similarity to the suggestions already
+// picked, as weighed by diversity.Tradeoff. Item similarity comes from
+// co-raters and attributes, as in GetSimilarItems. Cap rules limit the
+// suggestions picked per category, counting pinned items, and Pin rules then
+// place their items. If n is not positive, every suggestion is returned.
+func (r *Recommender) GetTopSuggestions(user *User, n int, diversity Diversity) (*SuggestionList, error) {
+	suggestionMap, err := r.GetSuggestions(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the ranking by index
+	candidates := make([]Suggestion, 0, len(suggestionMap))
+	for _, suggestion := range suggestionMap {
+		candidates = append(candidates, suggestion)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.Item.Id < b.Item.Id
+	})
+	// Read the rules, the pinned items and the similarity records among the
+	// candidates
+	var rules ruleSet
+	var pinned []Suggestion
+	var positions []int
+	records := make(map[string]map[string]similarityRecord)
+	if err := r.view(func(tx namespace) error {
+		var err error
+		if rules, err = r.getRules(tx); err != nil {
+			return err
+		}
+		if pinned, positions, err = r.pinnedSuggestions(tx, user, rules, suggestionMap, r.clock()); err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			itemRecords, err := r.getRecords(tx, itemSimilarityBucketName, candidate.Item.Id)
+			if err != nil {
+				return err
+			}
+			records[candidate.Item.Id] = itemRecords
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	similarity := func(a, b *Item) float32 {
+		index := float32(blendedSimilarity(records[a.Id][b.Id], a, b))
+		if index < 0 {
+			return 0
+		}
+		return index
+	}
+
+	// Pinned items are placed last, so they are not picked here
+	for _, suggestion := range pinned {
+		for i, candidate := range candidates {
+			if candidate.Item.Id == suggestion.Item.Id {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	total := len(candidates) + len(pinned)
+	if n <= 0 || n > total {
+		n = total
+	}
+	// Pins are sorted by position, so when there are more than n, the first
+	// n are kept
+	if len(pinned) > n {
+		pinned, positions = pinned[:n], positions[:n]
+	}
+
+	// Greedily pick the candidate with the best marginal relevance
+	list := &SuggestionList{}
+	for len(list.Suggestions) < n-len(pinned) {
+		best, bestScore := -1, float32(0)
+		for i, candidate := range candidates {
+			if rules.capped(&candidate.Item, append(pinned[:len(pinned):len(pinned)], list.Suggestions...)) {
+				continue
+			}
+			var redundancy float32
+			for _, picked := range list.Suggestions {
+				if s := similarity(&candidate.Item, &picked.Item); s > redundancy {
+					redundancy = s
+				}
+			}
+			score := (1-diversity.Tradeoff)*float32(candidate.Index) - diversity.Tradeoff*redundancy
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		list.Suggestions = append(list.Suggestions, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+
+	list.Suggestions = placePins(list.Suggestions, pinned, positions)
+
+	// Intra-list diversity
+	var dissimilarity float32
+	var pairs int
+	for i := range list.Suggestions {
+		for j := i + 1; j < len(list.Suggestions); j++ {
+			dissimilarity += 1 - similarity(&list.Suggestions[i].Item, &list.Suggestions[j].Item)
+			pairs++
+		}
+	}
+	if pairs > 0 {
+		list.Diversity = dissimilarity / float32(pairs)
+	}
+
+	return list, nil
+}
+
+// pinnedSuggestions returns the suggestions of the items pinned by the rules,
+// by position, along with their positions. Items the user has hidden or
+// rated, unavailable items and items excluded by an Exclude rule are left
+// out: Exclude takes precedence over Pin. Pinned items that are suggested
+// keep their index; others have index 0.
+func (r *Recommender) pinnedSuggestions(tx namespace, user *User, rules ruleSet, suggestionMap map[string]Suggestion, now time.Time) ([]Suggestion, []int, error) {
+	var pinned []Suggestion
+	var positions []int
+	itemBucket := tx.Bucket([]byte(itemBucketName))
+	seen := make(map[string]bool)
+	for _, pin := range rules.pins() {
+		itemId := pin.Match.ItemId
+		data := itemBucket.Get([]byte(itemId))
+		if data == nil || seen[itemId] || inSet(tx, hiddenBucketName, user.Id, itemId) {
+			continue
+		}
+		if inSet(tx, userLikesBucketName, user.Id, itemId) || inSet(tx, userDislikesBucketName, user.Id, itemId) {
+			continue
+		}
+		seen[itemId] = true
+		suggestion := suggestionMap[itemId]
+		if err := r.codec.Unmarshal(data, &suggestion.Item); err != nil {
+			return nil, nil, err
+		}
+		if !suggestion.Item.available(now) {
+			continue
+		}
+		if _, kept := rules.apply(suggestion); !kept {
+			continue
+		}
+		pinned = append(pinned, suggestion)
+		positions = append(positions, pin.Position)
+	}
+	return pinned, positions, nil
+}
+
+// placePins inserts the pinned suggestions into the list, in order of
+// position. Positions past the end of the list place the item last.
+func placePins(list, pinned []Suggestion, positions []int) []Suggestion {
+	for i, suggestion := range pinned {
+		position := positions[i]
+		if position < 0 {
+			position = 0
+		}
+		if position > len(list) {
+			position = len(list)
+		}
+		list = append(list, Suggestion{})
+		copy(list[position+1:], list[position:])
+		list[position] = suggestion
+	}
+	return list
+}
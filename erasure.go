@@ -0,0 +1,168 @@
+package recommender
+
+import "sort"
+
+// ErasureReport describes what DeleteUser removed.
+type ErasureReport struct {
+	UserId string `json:"userId"`
+	// Deleted counts the entries removed, by bucket.
+	Deleted map[string]int `json:"deleted"`
+	// Recomputed lists the users whose suggestions were recomputed because
+	// they shared ratings with the deleted user, ordered by ID.
+	Recomputed []string `json:"recomputed"`
+}
+
+// count adds n deleted entries of the named bucket.
+func (e *ErasureReport) count(bucketName string, n int) {
+	if n > 0 {
+		e.Deleted[bucketName] += n
+	}
+}
+
+// DeleteUser erases a user: their record, ratings, rating history, implicit
+// feedback, similarity records, suggestions, hidden items and impressions
+// are removed in a single transaction. Similarity records between items are
+// adjusted as if each rating had been removed. Users who shared a rated item
+// with the deleted user are then given new suggestions. Per-item impression
+// totals keep the deleted user's anonymous contribution.
+func (r *Recommender) DeleteUser(user *User) (*ErasureReport, error) {
+	report := &ErasureReport{UserId: user.Id, Deleted: make(map[string]int)}
+	var neighbors map[string]bool
+	if err := r.update(func(tx namespace) error {
+		var err error
+		neighbors, err = r.eraseUser(tx, user, report)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	for otherId := range neighbors {
+		if err := r.UpdateSuggestions(&User{Id: otherId}); err != nil {
+			return nil, err
+		}
+		report.Recomputed = append(report.Recomputed, otherId)
+	}
+	sort.Strings(report.Recomputed)
+	return report, nil
+}
+
+// eraseUser removes every trace of the user within the given transaction,
+// counting what it removes in the report. It returns the users whose
+// suggestions may depend on the erased user, which it marks stale.
+func (r *Recommender) eraseUser(tx namespace, user *User, report *ErasureReport) (map[string]bool, error) {
+	neighbors := make(map[string]bool)
+
+	// Find the users whose suggestions may depend on this user
+	similar := setMembers(tx, userSimilarityBucketName, user.Id)
+	for otherId := range similar {
+		neighbors[otherId] = true
+	}
+	rated, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	strengths, err := r.implicitStrengths(tx, userImplicitBucketName, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]bool)
+	for itemId := range rated {
+		items[itemId] = true
+	}
+	for itemId := range strengths {
+		items[itemId] = true
+	}
+	for itemId := range items {
+		raters, err := r.raters(tx, itemId)
+		if err != nil {
+			return nil, err
+		}
+		for otherId := range raters {
+			neighbors[otherId] = true
+		}
+	}
+	delete(neighbors, user.Id)
+
+	// Remove ratings, adjusting the similarity records they are part of
+	report.count(userLikesBucketName, len(setMembers(tx, userLikesBucketName, user.Id)))
+	report.count(userDislikesBucketName, len(setMembers(tx, userDislikesBucketName, user.Id)))
+	report.count(userSimilarityBucketName, len(similar))
+	report.count(ratingLogBucketName, len(setMembers(tx, userRatingLogBucketName, user.Id)))
+	for itemId := range rated {
+		if err := r.setRating(tx, user, &Item{Id: itemId}, 0); err != nil {
+			return nil, err
+		}
+	}
+	for itemId := range strengths {
+		if err := deleteNested(tx, itemImplicitBucketName, itemId, user.Id); err != nil {
+			return nil, err
+		}
+	}
+	report.count(userImplicitBucketName, len(strengths))
+	if err := deleteAllNested(tx, userImplicitBucketName, user.Id); err != nil {
+		return nil, err
+	}
+
+	// Erase the rating history, including the removals just logged
+	logBucket := tx.Bucket([]byte(ratingLogBucketName))
+	for indexKey := range setMembers(tx, userRatingLogBucketName, user.Id) {
+		logKey := []byte(indexKey[12:])
+		if data := logBucket.Get(logKey); data != nil {
+			var event RatingEvent
+			if err := r.codec.Unmarshal(data, &event); err != nil {
+				return nil, err
+			}
+			if err := deleteNested(tx, itemRatingLogBucketName, event.ItemId, indexKey); err != nil {
+				return nil, err
+			}
+			if err := logBucket.Delete(logKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := deleteAllNested(tx, userRatingLogBucketName, user.Id); err != nil {
+		return nil, err
+	}
+
+	// Remove similarity records left over, in both directions
+	for otherId := range setMembers(tx, userSimilarityBucketName, user.Id) {
+		if err := deleteNested(tx, userSimilarityBucketName, otherId, user.Id); err != nil {
+			return nil, err
+		}
+	}
+	if err := deleteAllNested(tx, userSimilarityBucketName, user.Id); err != nil {
+		return nil, err
+	}
+
+	// Remove whatever else is kept per user
+	for _, bucketName := range []string{suggestionBucketName, hiddenBucketName, impressionBucketName} {
+		report.count(bucketName, len(setMembers(tx, bucketName, user.Id)))
+		if err := deleteAllNested(tx, bucketName, user.Id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Bucket([]byte(staleSuggestionsBucketName)).Delete([]byte(user.Id)); err != nil {
+		return nil, err
+	}
+	userBucket := tx.Bucket([]byte(userBucketName))
+	if data := userBucket.Get([]byte(user.Id)); data != nil {
+		var stored User
+		if err := r.codec.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		if err := deleteIndexEntries(tx, userExternalIdBucketName, userNameBucketName, user.Id, stored.ExternalId, stored.Name); err != nil {
+			return nil, err
+		}
+		if err := userBucket.Delete([]byte(user.Id)); err != nil {
+			return nil, err
+		}
+		report.count(userBucketName, 1)
+	}
+
+	for otherId := range neighbors {
+		if err := markSuggestionsStale(tx, otherId); err != nil {
+			return nil, err
+		}
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,101 @@
+package recommender
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrUserNotFound is returned when looking up a user that does not exist.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrItemNotFound is returned when looking up an item that does not exist.
+	ErrItemNotFound = errors.New("item not found")
+	// ErrInvalidScore is returned for a score other than a like, a dislike or
+	// none.
+	ErrInvalidScore = errors.New("invalid score")
+	// ErrInvalidInput is wrapped by errors reporting invalid arguments, such
+	// as a malformed filter or an unknown rule kind.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrClosed is returned by operations on a closed Recommender.
+	ErrClosed = errors.New("recommender is closed")
+	// ErrTenantNotFound is returned by operations on a deleted tenant.
+	ErrTenantNotFound = errors.New("tenant not found")
+)
+
+// StorageError is returned when reading or writing the database fails.
+type StorageError struct {
+	Err error
+}
+
+// Error represents a StorageError as a string
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage: %s", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// invalidInput returns an error wrapping ErrInvalidInput.
+func invalidInput(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidInput, fmt.Sprintf(format, args...))
+}
+
+// storageError classifies an error returned by the database: errors of this
+// package are returned as they are, and any other is wrapped in a
+// *StorageError.
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return ErrClosed
+	}
+	for _, target := range []error{ErrUserNotFound, ErrItemNotFound, ErrInvalidScore, ErrInvalidInput, ErrClosed, ErrTenantNotFound} {
+		if errors.Is(err, target) {
+			return err
+		}
+	}
+	var storage *StorageError
+	var version *SchemaVersionError
+	if errors.As(err, &storage) || errors.As(err, &version) {
+		return err
+	}
+	return &StorageError{Err: err}
+}
+
+// view runs fn in a read-only transaction on the Recommender's tenant,
+// classifying its error.
+func (r *Recommender) view(fn func(namespace) error) error {
+	return r.logStorageError(storageError(r.db.View(func(tx *bolt.Tx) error {
+		ns, err := r.namespace(tx)
+		if err != nil {
+			return err
+		}
+		return fn(ns)
+	})))
+}
+
+// update runs fn in a read-write transaction on the Recommender's tenant,
+// classifying its error.
+func (r *Recommender) update(fn func(namespace) error) error {
+	return r.logStorageError(storageError(r.db.Update(func(tx *bolt.Tx) error {
+		ns, err := r.namespace(tx)
+		if err != nil {
+			return err
+		}
+		return fn(ns)
+	})))
+}
+
+// logStorageError logs err if it is a *StorageError, and returns it.
+func (r *Recommender) logStorageError(err error) error {
+	var storage *StorageError
+	if errors.As(err, &storage) {
+		r.logger.Error("storage failure", "error", storage.Err)
+	}
+	return err
+}
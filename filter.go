@@ -0,0 +1,304 @@
+package recommender
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A filter expression selects items by ID and attributes, for example
+//
+//	state = "Colorado" and not (season in ("winter", "spring") or id = "...")
+//
+// Comparisons are = and !=, and in, against a list of values. The field id
+// is the item's ID; any other field is an attribute, which is empty when the
+// item does not have it. Values are double-quoted strings, or bare words such
+// as numbers. Comparisons combine with and, or, not and parentheses; and
+// binds tighter than or. Keywords are case-insensitive.
+
+// filter selects items.
+type filter interface {
+	matches(item *Item) bool
+}
+
+type andFilter []filter
+
+func (f andFilter) matches(item *Item) bool {
+	for _, operand := range f {
+		if !operand.matches(item) {
+			return false
+		}
+	}
+	return true
+}
+
+type orFilter []filter
+
+func (f orFilter) matches(item *Item) bool {
+	for _, operand := range f {
+		if operand.matches(item) {
+			return true
+		}
+	}
+	return false
+}
+
+type notFilter struct {
+	operand filter
+}
+
+func (f notFilter) matches(item *Item) bool {
+	return !f.operand.matches(item)
+}
+
+// inFilter matches items whose field equals one of the values. A single value
+// expresses =.
+type inFilter struct {
+	field  string
+	values []string
+}
+
+func (f inFilter) matches(item *Item) bool {
+	value := item.Attributes[f.field]
+	if f.field == "id" {
+		value = item.Id
+	}
+	for _, v := range f.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAll matches every item; it is the filter of an empty expression.
+type matchAll struct{}
+
+func (matchAll) matches(*Item) bool {
+	return true
+}
+
+// token is a lexical token of a filter expression. Strings are unquoted and
+// have quoted set.
+type token struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+// tokenize splits a filter expression into tokens.
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c, width := utf8.DecodeRuneInString(expr[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += width
+		case strings.ContainsRune("(),=", c):
+			tokens = append(tokens, token{text: string(c), pos: i})
+			i++
+		case c == '!':
+			if !strings.HasPrefix(expr[i:], "!=") {
+				return nil, invalidInput("filter: unexpected %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{text: "!=", pos: i})
+			i += 2
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, invalidInput("filter: unterminated string at position %d", i)
+			}
+			text, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, invalidInput("filter: invalid string at position %d", i)
+			}
+			tokens = append(tokens, token{text: text, quoted: true, pos: i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(expr) {
+				r, width := utf8.DecodeRuneInString(expr[end:])
+				if unicode.IsSpace(r) || strings.ContainsRune("(),=!\"", r) {
+					break
+				}
+				end += width
+			}
+			tokens = append(tokens, token{text: expr[i:end], pos: i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// parser is a recursive descent parser of filter expressions.
+type parser struct {
+	tokens []token
+	pos    int
+	end    int
+}
+
+// parseFilter parses a filter expression. An empty expression matches every
+// item.
+func parseFilter(expr string) (filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return matchAll{}, nil
+	}
+	p := &parser{tokens: tokens, end: len(expr)}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+// errorf reports an error at the current token.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	pos := p.end
+	if p.pos < len(p.tokens) {
+		pos = p.tokens[p.pos].pos
+	}
+	return invalidInput("filter: %s at position %d", fmt.Sprintf(format, args...), pos)
+}
+
+// keyword reports whether the current token is the given unquoted keyword,
+// consuming it if so.
+func (p *parser) keyword(keyword string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (filter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	operands := orFilter{f}
+	for p.keyword("or") {
+		if f, err = p.and(); err != nil {
+			return nil, err
+		}
+		operands = append(operands, f)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *parser) and() (filter, error) {
+	f, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	operands := andFilter{f}
+	for p.keyword("and") {
+		if f, err = p.unary(); err != nil {
+			return nil, err
+		}
+		operands = append(operands, f)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *parser) unary() (filter, error) {
+	if p.keyword("not") {
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{f}, nil
+	}
+	if p.keyword("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, p.errorf("expected )")
+		}
+		return f, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (filter, error) {
+	field, err := p.word("field")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.keyword("="):
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return inFilter{field, []string{value}}, nil
+	case p.keyword("!="):
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{inFilter{field, []string{value}}}, nil
+	case p.keyword("in"):
+		if !p.keyword("(") {
+			return nil, p.errorf("expected (")
+		}
+		f := inFilter{field: field}
+		for {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			f.values = append(f.values, value)
+			if p.keyword(")") {
+				return f, nil
+			}
+			if !p.keyword(",") {
+				return nil, p.errorf("expected , or )")
+			}
+		}
+	}
+	return nil, p.errorf("expected =, != or in")
+}
+
+// word consumes an unquoted word other than punctuation.
+func (p *parser) word(what string) (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", p.errorf("expected %s", what)
+	}
+	t := p.tokens[p.pos]
+	if t.quoted || strings.ContainsAny(t.text, "(),=!") {
+		return "", p.errorf("expected %s", what)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// value consumes a string or a bare word.
+func (p *parser) value() (string, error) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].quoted {
+		p.pos++
+		return p.tokens[p.pos-1].text, nil
+	}
+	return p.word("value")
+}
@@ -0,0 +1,40 @@
+package recommender
+
+// Hidden items are stored per user under hidden/<user ID>, apart from
+// ratings, so hiding an item says nothing about the user's taste. Hidden
+// items are never suggested to the user.
+
+// Hide excludes an item from the user's suggestions without rating it. If the
+// item is already hidden, nothing happens.
+func (r *Recommender) Hide(user *User, item *Item) error {
+	return r.update(func(tx namespace) error {
+		if err := addToSet(tx, hiddenBucketName, user.Id, item.Id); err != nil {
+			return err
+		}
+		// Drop the stored suggestion, if any
+		return deleteNested(tx, suggestionBucketName, user.Id, item.Id)
+	})
+}
+
+// Unhide lets a hidden item be suggested to the user again. The user's
+// suggestions are recomputed, so the item reappears if it qualifies.
+func (r *Recommender) Unhide(user *User, item *Item) error {
+	var hidden bool
+	if err := r.update(func(tx namespace) error {
+		if hidden = inSet(tx, hiddenBucketName, user.Id, item.Id); !hidden {
+			return nil
+		}
+		return deleteNested(tx, hiddenBucketName, user.Id, item.Id)
+	}); err != nil {
+		return err
+	}
+	if !hidden {
+		return nil
+	}
+	return r.UpdateSuggestions(user)
+}
+
+// GetHiddenItems gets the Items the given User has hidden.
+func (r *Recommender) GetHiddenItems(user *User) (map[string]Item, error) {
+	return r.getItemSet(hiddenBucketName, user.Id)
+}
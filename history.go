@@ -0,0 +1,245 @@
+package recommender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every change to a rating is appended to the rating log, keyed by sequence
+// number. The log is indexed by user and by item: userRatingLog/<user ID> and
+// itemRatingLog/<item ID> hold one key per event, made of the event's time
+// followed by its sequence number, so that a time range is a cursor scan. Every
+// change is logged, so replaying the log yields the current ratings.
+
+// RatingEvent is a change to a user's rating of an item. A zero Score means
+// the rating was removed. Events recorded before ratings were timestamped
+// have a zero Time.
+type RatingEvent struct {
+	UserId string    `json:"userId"`
+	ItemId string    `json:"itemId"`
+	Score  Score     `json:"score"`
+	Time   time.Time `json:"time"`
+}
+
+// String represents a RatingEvent as a string
+func (e RatingEvent) String() string {
+	var score string
+	switch e.Score {
+	case like:
+		score = "like"
+	case dislike:
+		score = "dislike"
+	default:
+		score = "unrate"
+	}
+	return fmt.Sprintf("%s %s %s at %s", e.UserId, score, e.ItemId, e.Time.Format(time.RFC3339))
+}
+
+// timeKey encodes t so that keys sort in time order: seconds since the epoch
+// with the sign bit flipped, then nanoseconds.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[8:], uint32(t.Nanosecond()))
+	return key
+}
+
+// timeFromKey decodes a time encoded by timeKey.
+func timeFromKey(key []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+	return time.Unix(sec, int64(binary.BigEndian.Uint32(key[8:])))
+}
+
+// logRating appends the event to the rating log and its indexes.
+func logRating(tx namespace, codec Codec, event RatingEvent) error {
+	logBucket := tx.Bucket([]byte(ratingLogBucketName))
+	seq, err := logBucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	logKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(logKey, seq)
+
+	data, err := codec.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	if err := logBucket.Put(logKey, data); err != nil {
+		return err
+	}
+
+	indexKey := string(append(timeKey(event.Time), logKey...))
+	if err := addToSet(tx, userRatingLogBucketName, event.UserId, indexKey); err != nil {
+		return err
+	}
+	return addToSet(tx, itemRatingLogBucketName, event.ItemId, indexKey)
+}
+
+// GetUserHistory returns the changes to the user's ratings from time from up
+// to, but not including, time to, oldest first.
+func (r *Recommender) GetUserHistory(user *User, from, to time.Time) ([]RatingEvent, error) {
+	return r.getHistory(userRatingLogBucketName, user.Id, from, to)
+}
+
+// GetItemHistory returns the changes to ratings of the item from time from up
+// to, but not including, time to, oldest first.
+func (r *Recommender) GetItemHistory(item *Item, from, to time.Time) ([]RatingEvent, error) {
+	return r.getHistory(itemRatingLogBucketName, item.Id, from, to)
+}
+
+// getHistory reads the events in the index stored under key in the named
+// bucket that fall within [from, to).
+func (r *Recommender) getHistory(bucketName, key string, from, to time.Time) ([]RatingEvent, error) {
+	var events []RatingEvent
+
+	if err := r.view(func(tx namespace) error {
+		indexBucket := nestedBucket(tx, bucketName, key)
+		if indexBucket == nil {
+			return nil
+		}
+		logBucket := tx.Bucket([]byte(ratingLogBucketName))
+		end := timeKey(to)
+		cur := indexBucket.Cursor()
+		for indexKey, _ := cur.Seek(timeKey(from)); indexKey != nil && bytes.Compare(indexKey[:12], end) < 0; indexKey, _ = cur.Next() {
+			data := logBucket.Get(indexKey[12:])
+			if data == nil {
+				continue
+			}
+			var event RatingEvent
+			if err := r.codec.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// ratingTimes returns when the user last changed the rating of each item,
+// according to the rating log.
+func (r *Recommender) ratingTimes(tx namespace, userId string) (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+	indexBucket := nestedBucket(tx, userRatingLogBucketName, userId)
+	if indexBucket == nil {
+		return times, nil
+	}
+	logBucket := tx.Bucket([]byte(ratingLogBucketName))
+	cur := indexBucket.Cursor()
+	for indexKey, _ := cur.First(); indexKey != nil; indexKey, _ = cur.Next() {
+		data := logBucket.Get(indexKey[12:])
+		if data == nil {
+			continue
+		}
+		var event RatingEvent
+		if err := r.codec.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		times[event.ItemId] = event.Time
+	}
+	return times, nil
+}
+
+// ReplayRatingLog rebuilds the like and dislike sets by replaying the rating
+// log: each pair gets the score of its latest event, and pairs whose latest
+// event removed the rating, or whose user or item no longer exists, are left
+// out. Similarity records are recomputed from the result, and so are the
+// suggestions of every user. The log itself is not changed.
+func (r *Recommender) ReplayRatingLog() error {
+	var userIds []string
+
+	if err := r.update(func(tx namespace) error {
+		ratings, err := r.replayRatings(tx)
+		if err != nil {
+			return err
+		}
+		if err := r.writeRatings(tx, ratings); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(userBucketName)).ForEach(func(userId, _ []byte) error {
+			userIds = append(userIds, string(userId))
+			return markSuggestionsStale(tx, string(userId))
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, userId := range userIds {
+		if err := r.UpdateSuggestions(&User{Id: userId}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayRatings returns the ratings that follow from the rating log, keyed by
+// user ID and then item ID, leaving out missing users and items.
+func (r *Recommender) replayRatings(tx namespace) (map[string]map[string]Score, error) {
+	ratings := make(map[string]map[string]Score)
+	userBucket := tx.Bucket([]byte(userBucketName))
+	itemBucket := tx.Bucket([]byte(itemBucketName))
+
+	// Sequence numbers are big-endian, so the log is read in order
+	cur := tx.Bucket([]byte(ratingLogBucketName)).Cursor()
+	for key, data := cur.First(); key != nil; key, data = cur.Next() {
+		var event RatingEvent
+		if err := r.codec.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		if userBucket.Get([]byte(event.UserId)) == nil || itemBucket.Get([]byte(event.ItemId)) == nil {
+			continue
+		}
+		if event.Score == 0 {
+			delete(ratings[event.UserId], event.ItemId)
+			continue
+		}
+		if ratings[event.UserId] == nil {
+			ratings[event.UserId] = make(map[string]Score)
+		}
+		ratings[event.UserId][event.ItemId] = event.Score
+	}
+	return ratings, nil
+}
+
+// seedRatingLog creates the rating log of a file from before ratings were
+// logged, with one untimed event per current rating.
+func seedRatingLog(tx *bolt.Tx) error {
+	codec, exists := codecs[getCodecName(tx)]
+	if !exists {
+		return fmt.Errorf("database is encoded with unknown codec %q", getCodecName(tx))
+	}
+	for _, bucketName := range []string{ratingLogBucketName, userRatingLogBucketName, itemRatingLogBucketName} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+			return err
+		}
+	}
+	for bucketName, score := range map[string]Score{userLikesBucketName: like, userDislikesBucketName: dislike} {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			continue
+		}
+		var events []RatingEvent
+		if err := bucket.ForEach(func(userId, _ []byte) error {
+			for itemId := range setMembers(tx, bucketName, string(userId)) {
+				events = append(events, RatingEvent{UserId: string(userId), ItemId: itemId, Score: score})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := logRating(tx, codec, event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package recommender
+
+import "time"
+
+// EventType names a kind of implicit feedback, such as a view or a purchase.
+type EventType string
+
+const (
+	View      EventType = "view"
+	Click     EventType = "click"
+	AddToCart EventType = "addToCart"
+	Purchase  EventType = "purchase"
+	// Dwell is time spent on an item, recorded in seconds.
+	Dwell EventType = "dwell"
+)
+
+// defaultEventWeights are used unless WithEventWeights is given.
+var defaultEventWeights = map[EventType]float32{
+	View:      0.1,
+	Click:     0.25,
+	AddToCart: 0.5,
+	Purchase:  1,
+	Dwell:     0.01,
+}
+
+// Implicit feedback is aggregated into a preference strength per user and
+// item, stored under userImplicit/<user ID>/<item ID> and mirrored under
+// itemImplicit/<item ID>/<user ID>. A pair with positive strength and no
+// explicit rating counts as a like, weighted by strength/(strength+1), so
+// that it counts for less than an explicit like however strong it grows.
+
+// Record adds implicit feedback from a user about an item: value times the
+// weight of the event type is added to the pair's preference strength. An
+// error is returned for event types without a weight. Since feedback arrives
+// far more often than ratings, the user's suggestions are only marked stale;
+// they are recomputed by the user's next rating, by UpdateSuggestions or
+// UpdateStaleSuggestions, or when the database is next opened.
+func (r *Recommender) Record(user *User, item *Item, eventType EventType, value float32) error {
+	weight, exists := r.eventWeights[eventType]
+	if !exists {
+		return invalidInput("no weight for event type %q", eventType)
+	}
+	return r.record(user, item, func(tx namespace, user *User, item *Item) error {
+		strength, err := r.implicitStrength(tx, user.Id, item.Id)
+		if err != nil {
+			return err
+		}
+		data, err := r.codec.Marshal(strength + weight*value)
+		if err != nil {
+			return err
+		}
+		if err := putNested(tx, userImplicitBucketName, user.Id, item.Id, data); err != nil {
+			return err
+		}
+		return putNested(tx, itemImplicitBucketName, item.Id, user.Id, data)
+	})
+}
+
+// GetImplicitStrength returns the preference strength aggregated from the
+// user's implicit feedback about the item.
+func (r *Recommender) GetImplicitStrength(user *User, item *Item) (float32, error) {
+	var strength float32
+	if err := r.view(func(tx namespace) error {
+		var err error
+		strength, err = r.implicitStrength(tx, user.Id, item.Id)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return strength, nil
+}
+
+// implicitStrength reads the preference strength of a user and item.
+func (r *Recommender) implicitStrength(tx namespace, userId, itemId string) (float32, error) {
+	var strength float32
+	bucket := nestedBucket(tx, userImplicitBucketName, userId)
+	if bucket == nil {
+		return 0, nil
+	}
+	if data := bucket.Get([]byte(itemId)); data != nil {
+		if err := r.codec.Unmarshal(data, &strength); err != nil {
+			return 0, err
+		}
+	}
+	return strength, nil
+}
+
+// implicitStrengths reads every preference strength stored under key in the
+// named bucket, keyed by the counterpart ID.
+func (r *Recommender) implicitStrengths(tx namespace, bucketName, key string) (map[string]float32, error) {
+	strengths := make(map[string]float32)
+	bucket := nestedBucket(tx, bucketName, key)
+	if bucket == nil {
+		return strengths, nil
+	}
+	cur := bucket.Cursor()
+	for id, data := cur.First(); id != nil; id, data = cur.Next() {
+		var strength float32
+		if err := r.codec.Unmarshal(data, &strength); err != nil {
+			return nil, err
+		}
+		strengths[string(id)] = strength
+	}
+	return strengths, nil
+}
+
+// weighted reports whether the user's similarity must be computed from
+// weighted preferences rather than read from the stored records, which count
+// explicit ratings only. That is the case with decay, and when implicit
+// feedback touches the user: the user has some, or someone has some about an
+// item the user rated. Users it does not touch keep reading the records.
+func (r *Recommender) weighted(tx namespace, userId string) bool {
+	if r.decay.enabled() {
+		return true
+	}
+	if nestedBucket(tx, userImplicitBucketName, userId) != nil {
+		return true
+	}
+	for _, bucketName := range []string{userLikesBucketName, userDislikesBucketName} {
+		for itemId := range setMembers(tx, bucketName, userId) {
+			if nestedBucket(tx, itemImplicitBucketName, itemId) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preferences returns the user's effective scores, explicit ratings and
+// implicit likes, and the weight of each. Explicit ratings take precedence
+// over implicit feedback about the same item.
+func (r *Recommender) preferences(tx namespace, userId string, now time.Time) (map[string]Score, map[string]float32, error) {
+	scores, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	weights, err := r.decayWeights(tx, userId, scores, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	strengths, err := r.implicitStrengths(tx, userImplicitBucketName, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	for itemId, strength := range strengths {
+		if _, rated := scores[itemId]; rated || strength <= 0 {
+			continue
+		}
+		// Implicit feedback is not timestamped, so it decays by item age only
+		weight := strength / (strength + 1)
+		if r.decay.By == ItemAge {
+			weight *= r.decay.weight(firstRated(tx, itemId), now)
+		}
+		scores[itemId] = like
+		weights[itemId] = weight
+	}
+	return scores, weights, nil
+}
+
+// raters returns the IDs of users with an effective score for the item.
+func (r *Recommender) raters(tx namespace, itemId string) (map[string]bool, error) {
+	raters := setMembers(tx, itemLikesBucketName, itemId)
+	for userId := range setMembers(tx, itemDislikesBucketName, itemId) {
+		raters[userId] = true
+	}
+	strengths, err := r.implicitStrengths(tx, itemImplicitBucketName, itemId)
+	if err != nil {
+		return nil, err
+	}
+	for userId, strength := range strengths {
+		if strength > 0 {
+			raters[userId] = true
+		}
+	}
+	return raters, nil
+}
+
+// weightedSimilarities computes the user's similarity to every user sharing
+// an effective score for some item, from weighted preferences.
+func (r *Recommender) weightedSimilarities(tx namespace, userId string, now time.Time) (map[string]pairSimilarity, error) {
+	scores, weights, err := r.preferences(tx, userId, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find users who share an item
+	others := make(map[string]bool)
+	for itemId := range scores {
+		raters, err := r.raters(tx, itemId)
+		if err != nil {
+			return nil, err
+		}
+		for id := range raters {
+			if id != userId {
+				others[id] = true
+			}
+		}
+	}
+
+	similarities := make(map[string]pairSimilarity)
+	for id := range others {
+		otherScores, otherWeights, err := r.preferences(tx, id, now)
+		if err != nil {
+			return nil, err
+		}
+		similarities[id] = weightedIndex(scores, otherScores, weights, otherWeights)
+	}
+	return similarities, nil
+}
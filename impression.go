@@ -0,0 +1,135 @@
+package recommender
+
+// Impressions and clicks are counted per user and item under
+// impressions/<user ID>/<item ID>, and in total per item under
+// itemImpressions/<item ID>.
+
+// impressionRecord counts how often an item was shown and clicked. Ignored
+// counts the times it was shown since it was last clicked.
+type impressionRecord struct {
+	Shown   int `json:"shown"`
+	Clicked int `json:"clicked"`
+	Ignored int `json:"ignored"`
+}
+
+// Engagement reports how often an item was shown to users and clicked.
+type Engagement struct {
+	Item             Item    `json:"item"`
+	Impressions      int     `json:"impressions"`
+	Clicks           int     `json:"clicks"`
+	ClickThroughRate float32 `json:"clickThroughRate"`
+}
+
+// Suppression demotes suggestions the user keeps ignoring. The zero value
+// demotes nothing.
+type Suppression struct {
+	// After is the number of impressions without a click after which an
+	// item is demoted. Zero disables suppression.
+	After int
+	// Penalty is subtracted from the index of a demoted item.
+	Penalty SuggestionIndex
+}
+
+// demote returns index less the penalty, if the record shows the item was
+// ignored too often.
+func (s Suppression) demote(index SuggestionIndex, record impressionRecord) SuggestionIndex {
+	if s.After <= 0 || record.Ignored < s.After {
+		return index
+	}
+	return index - s.Penalty
+}
+
+// RecordImpression records that an item was shown to the user, typically as
+// a suggestion.
+func (r *Recommender) RecordImpression(user *User, item *Item) error {
+	return r.updateImpressions(user, item, func(record impressionRecord) impressionRecord {
+		record.Shown++
+		record.Ignored++
+		return record
+	})
+}
+
+// RecordClick records that the user clicked an item that was shown, which
+// ends any suppression of the item for the user.
+func (r *Recommender) RecordClick(user *User, item *Item) error {
+	return r.updateImpressions(user, item, func(record impressionRecord) impressionRecord {
+		record.Clicked++
+		record.Ignored = 0
+		return record
+	})
+}
+
+// updateImpressions applies update to the user's record for the item and to
+// the item's total.
+func (r *Recommender) updateImpressions(user *User, item *Item, update func(impressionRecord) impressionRecord) error {
+	return r.update(func(tx namespace) error {
+		record, err := r.impressions(tx, user.Id, item.Id)
+		if err != nil {
+			return err
+		}
+		data, err := r.codec.Marshal(update(record))
+		if err != nil {
+			return err
+		}
+		if err := putNested(tx, impressionBucketName, user.Id, item.Id, data); err != nil {
+			return err
+		}
+
+		itemImpressionBucket := tx.Bucket([]byte(itemImpressionBucketName))
+		var total impressionRecord
+		if data := itemImpressionBucket.Get([]byte(item.Id)); data != nil {
+			if err := r.codec.Unmarshal(data, &total); err != nil {
+				return err
+			}
+		}
+		data, err = r.codec.Marshal(update(total))
+		if err != nil {
+			return err
+		}
+		return itemImpressionBucket.Put([]byte(item.Id), data)
+	})
+}
+
+// impressions reads the user's record for the item.
+func (r *Recommender) impressions(tx namespace, userId, itemId string) (impressionRecord, error) {
+	var record impressionRecord
+	bucket := nestedBucket(tx, impressionBucketName, userId)
+	if bucket == nil {
+		return record, nil
+	}
+	if data := bucket.Get([]byte(itemId)); data != nil {
+		if err := r.codec.Unmarshal(data, &record); err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// GetEngagement reports how often the item was shown and clicked, across all
+// users.
+func (r *Recommender) GetEngagement(item *Item) (*Engagement, error) {
+	var total impressionRecord
+	var stored Item
+	if err := r.view(func(tx namespace) error {
+		var err error
+		if stored, err = r.storedItem(tx, item); err != nil {
+			return err
+		}
+		if data := tx.Bucket([]byte(itemImpressionBucketName)).Get([]byte(item.Id)); data != nil {
+			return r.codec.Unmarshal(data, &total)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	engagement := &Engagement{
+		Item:        stored,
+		Impressions: total.Shown,
+		Clicks:      total.Clicked,
+	}
+	if total.Shown > 0 {
+		engagement.ClickThroughRate = float32(total.Clicked) / float32(total.Shown)
+	}
+	return engagement, nil
+}
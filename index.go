@@ -0,0 +1,222 @@
+package recommender
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Users and items are indexed by external ID and by name. External IDs are
+// unique, so userExternalId and itemExternalId map each external ID straight
+// to the internal ID. Names are not, so userName/<name> and itemName/<name>
+// are sets of internal IDs. Items are also indexed by attribute:
+// itemAttribute/<attribute key> is the set of items with that attribute.
+
+// putIndexEntries replaces the index entries of a user or item: those of the
+// previous external ID and name are removed, and those of the current ones
+// added. An error is returned if the external ID already belongs to another
+// ID.
+func putIndexEntries(tx namespace, externalIdBucketName, nameBucketName, id, previousExternalId, previousName, externalId, name string) error {
+	externalIdBucket := tx.Bucket([]byte(externalIdBucketName))
+	if previousExternalId != "" && previousExternalId != externalId {
+		if err := externalIdBucket.Delete([]byte(previousExternalId)); err != nil {
+			return err
+		}
+	}
+	if externalId != "" {
+		if owner := externalIdBucket.Get([]byte(externalId)); owner != nil && string(owner) != id {
+			return invalidInput("external ID %q already belongs to %s", externalId, owner)
+		}
+		if err := externalIdBucket.Put([]byte(externalId), []byte(id)); err != nil {
+			return err
+		}
+	}
+	if previousName != name && previousName != "" {
+		if err := deleteNested(tx, nameBucketName, previousName, id); err != nil {
+			return err
+		}
+	}
+	// Bucket keys cannot be empty, so nameless users and items are not
+	// indexed by name
+	if name == "" {
+		return nil
+	}
+	return addToSet(tx, nameBucketName, name, id)
+}
+
+// deleteIndexEntries removes the index entries of a user or item.
+func deleteIndexEntries(tx namespace, externalIdBucketName, nameBucketName, id, externalId, name string) error {
+	if externalId != "" {
+		if err := tx.Bucket([]byte(externalIdBucketName)).Delete([]byte(externalId)); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	return deleteNested(tx, nameBucketName, name, id)
+}
+
+// attributeKey is the key of an attribute in the attribute index: its name
+// and value, separated by a NUL.
+func attributeKey(name, value string) string {
+	return name + "\x00" + value
+}
+
+// putAttributeEntries replaces the attribute index entries of an item: those
+// of previous attributes it no longer has are removed, and those of its
+// current attributes added. Nil current attributes remove every entry.
+func putAttributeEntries(tx namespace, id string, previous, current map[string]string) error {
+	for name, value := range previous {
+		if currentValue, exists := current[name]; exists && currentValue == value {
+			continue
+		}
+		if err := deleteNested(tx, itemAttributeBucketName, attributeKey(name, value), id); err != nil {
+			return err
+		}
+	}
+	for name, value := range current {
+		if err := addToSet(tx, itemAttributeBucketName, attributeKey(name, value), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUser retrieves the User with the given ID, or ErrUserNotFound.
+func (r *Recommender) GetUser(id string) (*User, error) {
+	return r.getUser(id)
+}
+
+// GetItem retrieves the Item with the given ID, or ErrItemNotFound.
+func (r *Recommender) GetItem(id string) (*Item, error) {
+	return r.getItem(id)
+}
+
+// GetUserByExternalId retrieves the User with the given external ID, or
+// ErrUserNotFound.
+func (r *Recommender) GetUserByExternalId(externalId string) (*User, error) {
+	id, err := r.lookupExternalId(userExternalIdBucketName, externalId)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetUser(id)
+}
+
+// GetItemByExternalId retrieves the Item with the given external ID, or
+// ErrItemNotFound.
+func (r *Recommender) GetItemByExternalId(externalId string) (*Item, error) {
+	id, err := r.lookupExternalId(itemExternalIdBucketName, externalId)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetItem(id)
+}
+
+// lookupExternalId returns the internal ID indexed under the external ID, or
+// "" if there is none.
+func (r *Recommender) lookupExternalId(bucketName, externalId string) (string, error) {
+	var id string
+	if err := r.view(func(tx namespace) error {
+		id = string(tx.Bucket([]byte(bucketName)).Get([]byte(externalId)))
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetUsersByName retrieves the Users with the given name.
+func (r *Recommender) GetUsersByName(name string) (map[string]User, error) {
+	return r.getUserSet(userNameBucketName, name)
+}
+
+// GetItemsByName retrieves the Items with the given name.
+func (r *Recommender) GetItemsByName(name string) (map[string]Item, error) {
+	return r.getItemSet(itemNameBucketName, name)
+}
+
+// indexNames builds the external ID and name indexes of a file from before
+// they existed. Users and items of that time have no external IDs.
+func indexNames(tx *bolt.Tx) error {
+	codec, exists := codecs[getCodecName(tx)]
+	if !exists {
+		return fmt.Errorf("database is encoded with unknown codec %q", getCodecName(tx))
+	}
+	for _, bucketName := range []string{userExternalIdBucketName, itemExternalIdBucketName, userNameBucketName, itemNameBucketName} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+			return err
+		}
+	}
+	if userBucket := tx.Bucket([]byte(userBucketName)); userBucket != nil {
+		if err := userBucket.ForEach(func(id, data []byte) error {
+			var user User
+			if err := codec.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			return putIndexEntries(tx, userExternalIdBucketName, userNameBucketName, string(id), "", "", "", user.Name)
+		}); err != nil {
+			return err
+		}
+	}
+	if itemBucket := tx.Bucket([]byte(itemBucketName)); itemBucket != nil {
+		if err := itemBucket.ForEach(func(id, data []byte) error {
+			var item Item
+			if err := codec.Unmarshal(data, &item); err != nil {
+				return err
+			}
+			return putIndexEntries(tx, itemExternalIdBucketName, itemNameBucketName, string(id), "", "", "", item.Name)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexAttributes builds the attribute index of a file from before it
+// existed, in the default tenant and every other.
+func indexAttributes(tx *bolt.Tx) error {
+	codec, exists := codecs[getCodecName(tx)]
+	if !exists {
+		return fmt.Errorf("database is encoded with unknown codec %q", getCodecName(tx))
+	}
+	index := func(ns namespace) error {
+		if _, err := ns.CreateBucketIfNotExists([]byte(itemAttributeBucketName)); err != nil {
+			return err
+		}
+		itemBucket := ns.Bucket([]byte(itemBucketName))
+		if itemBucket == nil {
+			return nil
+		}
+		return itemBucket.ForEach(func(id, data []byte) error {
+			var item Item
+			if err := codec.Unmarshal(data, &item); err != nil {
+				return err
+			}
+			return putAttributeEntries(ns, string(id), nil, item.Attributes)
+		})
+	}
+
+	if err := index(tx); err != nil {
+		return err
+	}
+	tenants := tx.Bucket([]byte(tenantBucketName))
+	if tenants == nil {
+		return nil
+	}
+	// Collect the tenants first, since their bucket cannot be modified while
+	// it is iterated
+	var names [][]byte
+	if err := tenants.ForEach(func(name, _ []byte) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := index(tenants.Bucket(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
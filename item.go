@@ -2,21 +2,83 @@ package recommender
 
 import (
 	"fmt"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
 type Item struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
+	Id         string            `json:"id"`
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Inactive items keep their ratings, and so count towards similarity,
+	// but are never suggested.
+	Inactive bool `json:"inactive,omitempty"`
+	// AvailableFrom and AvailableUntil bound when the item may be suggested.
+	// The zero time leaves that end open.
+	AvailableFrom  time.Time `json:"availableFrom"`
+	AvailableUntil time.Time `json:"availableUntil"`
+	// ExternalId is the caller's own ID for the item, such as a SKU.
+	ExternalId string `json:"externalId,omitempty"`
 }
 
+// itemNamespace is the namespace of the v5 UUIDs derived from external item
+// IDs.
+var itemNamespace = uuid.NewV5(uuid.NamespaceURL, "github.com/nikovacevic/recommender/item")
+
 // NewItem creates and returns an Item
 func NewItem(name string) *Item {
 	return &Item{Id: uuid.NewV4().String(), Name: name}
 }
 
+// NewExternalItem creates and returns an Item known to the caller by
+// externalId. Its ID is a v5 UUID derived from externalId, so the same
+// external ID always yields the same Item ID.
+func NewExternalItem(externalId, name string) *Item {
+	return &Item{Id: uuid.NewV5(itemNamespace, externalId).String(), Name: name, ExternalId: externalId}
+}
+
 // String represents an Item as a string
 func (i Item) String() string {
 	return fmt.Sprintf("%s", i.Name)
 }
+
+// available reports whether the item may be suggested at time now.
+func (i Item) available(now time.Time) bool {
+	if i.Inactive {
+		return false
+	}
+	if !i.AvailableFrom.IsZero() && now.Before(i.AvailableFrom) {
+		return false
+	}
+	return i.AvailableUntil.IsZero() || now.Before(i.AvailableUntil)
+}
+
+// blendedSimilarity returns the similarity of two items from the record of
+// their co-raters, with shared attributes counting as one additional co-rater
+// when both items have attributes.
+func blendedSimilarity(record similarityRecord, item1, item2 *Item) SimilarityIndex {
+	if len(item1.Attributes) == 0 || len(item2.Attributes) == 0 {
+		return record.index()
+	}
+	coRaters := float32(record.overlap())
+	index := float32(record.index())
+	return SimilarityIndex((index*coRaters + attributeSimilarity(item1, item2)) / (coRaters + 1))
+}
+
+// attributeSimilarity returns the share of attributes two items have in
+// common, from 0 (nothing shared) to 1 (identical attributes). Items without
+// attributes share nothing.
+func attributeSimilarity(item1, item2 *Item) float32 {
+	if len(item1.Attributes) == 0 || len(item2.Attributes) == 0 {
+		return 0
+	}
+	shared := 0
+	for key, value := range item1.Attributes {
+		if other, exists := item2.Attributes[key]; exists && other == value {
+			shared++
+		}
+	}
+	union := len(item1.Attributes) + len(item2.Attributes) - shared
+	return float32(shared) / float32(union)
+}
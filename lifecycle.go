@@ -0,0 +1,99 @@
+package recommender
+
+// DeleteItem removes an item and every rating of it. Each rating is removed
+// as by Unrate, so the rating log records it and similarity records are
+// adjusted; implicit feedback, similarity records, suggestions, hidden marks
+// and impressions of the item are then dropped. The suggestions of the users
+// who rated it are recomputed. The rating log keeps its history.
+func (r *Recommender) DeleteItem(item *Item) error {
+	var raters map[string]bool
+	if err := r.update(func(tx namespace) error {
+		var err error
+		if raters, err = r.raters(tx, item.Id); err != nil {
+			return err
+		}
+
+		// Remove ratings, adjusting the similarity records they are part of
+		for userId := range raters {
+			if err := r.setRating(tx, &User{Id: userId}, item, 0); err != nil {
+				return err
+			}
+		}
+		for userId := range setMembers(tx, itemImplicitBucketName, item.Id) {
+			if err := deleteNested(tx, userImplicitBucketName, userId, item.Id); err != nil {
+				return err
+			}
+		}
+		if err := deleteAllNested(tx, itemImplicitBucketName, item.Id); err != nil {
+			return err
+		}
+
+		// Remove whatever else refers to the item
+		for otherId := range setMembers(tx, itemSimilarityBucketName, item.Id) {
+			if err := deleteNested(tx, itemSimilarityBucketName, otherId, item.Id); err != nil {
+				return err
+			}
+		}
+		if err := deleteAllNested(tx, itemSimilarityBucketName, item.Id); err != nil {
+			return err
+		}
+		for _, bucketName := range []string{suggestionBucketName, hiddenBucketName, impressionBucketName} {
+			if err := deleteMemberEverywhere(tx, bucketName, item.Id); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket([]byte(itemImpressionBucketName)).Delete([]byte(item.Id)); err != nil {
+			return err
+		}
+		itemBucket := tx.Bucket([]byte(itemBucketName))
+		if data := itemBucket.Get([]byte(item.Id)); data != nil {
+			var stored Item
+			if err := r.codec.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			if err := deleteIndexEntries(tx, itemExternalIdBucketName, itemNameBucketName, item.Id, stored.ExternalId, stored.Name); err != nil {
+				return err
+			}
+			if err := putAttributeEntries(tx, item.Id, stored.Attributes, nil); err != nil {
+				return err
+			}
+		}
+		if err := itemBucket.Delete([]byte(item.Id)); err != nil {
+			return err
+		}
+
+		for userId := range raters {
+			if err := markSuggestionsStale(tx, userId); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for userId := range raters {
+		if err := r.UpdateSuggestions(&User{Id: userId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeactivateItem retires an item: its ratings still count towards
+// similarity, but it is no longer suggested. Saving the item with Inactive
+// unset makes it active again.
+func (r *Recommender) DeactivateItem(item *Item) error {
+	return r.update(func(tx namespace) error {
+		stored, err := r.storedItem(tx, item)
+		if err != nil {
+			return err
+		}
+		stored.Inactive = true
+		if err := r.saveItem(tx, &stored); err != nil {
+			return err
+		}
+		item.Inactive = true
+		return nil
+	})
+}
@@ -0,0 +1,27 @@
+package recommender
+
+import (
+	"context"
+	"log/slog"
+)
+
+// The Recommender logs through a *slog.Logger, set by WithLogger. Events are
+//
+//	debug	a rating written, suggestions recomputed, with their duration
+//	info	stale suggestions recovered on open
+//	warn	a missing user or item referenced by a set or record
+//	error	a failed read or write of the database
+//
+// Attributes are user, item, tenant and the like, holding IDs.
+
+// discardHandler drops every record, so that the Recommender is silent by
+// default.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// discardLogger is the logger of a Recommender without WithLogger.
+var discardLogger = slog.New(discardHandler{})
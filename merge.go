@@ -0,0 +1,164 @@
+package recommender
+
+// MergePolicy decides which rating survives when two users being merged
+// rated the same item differently.
+type MergePolicy int
+
+const (
+	// NewestWins keeps the rating changed most recently. Ratings of unknown
+	// age lose to timestamped ones; between two of unknown age, the target's
+	// rating is kept.
+	NewestWins MergePolicy = iota
+	// KeepTarget keeps the rating of the user merged into.
+	KeepTarget
+	// KeepSource keeps the rating of the user merged from.
+	KeepSource
+)
+
+// MergeUsers moves everything known about one user to another, typically an
+// anonymous visitor's profile into the account they signed in to. Ratings are
+// moved, with conflicting ones resolved by the policy; implicit feedback and
+// impressions are added to the target's, and hidden items are combined. The
+// source user is then deleted, as by DeleteUser, all in one transaction. The
+// suggestions of the target and of the source's neighbors are recomputed.
+func (r *Recommender) MergeUsers(from, into *User, policy MergePolicy) error {
+	switch policy {
+	case NewestWins, KeepTarget, KeepSource:
+	default:
+		return invalidInput("unknown merge policy %d", policy)
+	}
+	if from.Id == into.Id {
+		return nil
+	}
+
+	var neighbors map[string]bool
+	if err := r.update(func(tx namespace) error {
+		if err := r.addUser(tx, into); err != nil {
+			return err
+		}
+		if err := r.mergeRatings(tx, from, into, policy); err != nil {
+			return err
+		}
+		if err := r.mergeImplicit(tx, from, into); err != nil {
+			return err
+		}
+		if err := r.mergeImpressions(tx, from, into); err != nil {
+			return err
+		}
+		for itemId := range setMembers(tx, hiddenBucketName, from.Id) {
+			if err := addToSet(tx, hiddenBucketName, into.Id, itemId); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		report := &ErasureReport{UserId: from.Id, Deleted: make(map[string]int)}
+		if neighbors, err = r.eraseUser(tx, from, report); err != nil {
+			return err
+		}
+		neighbors[into.Id] = true
+		return markSuggestionsStale(tx, into.Id)
+	}); err != nil {
+		return err
+	}
+
+	for userId := range neighbors {
+		if err := r.UpdateSuggestions(&User{Id: userId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRatings gives the target the source's ratings, resolving conflicts by
+// the policy. Moved ratings are logged at the time the source made them.
+// Similarity records are kept current as the ratings change.
+func (r *Recommender) mergeRatings(tx namespace, from, into *User, policy MergePolicy) error {
+	fromScores, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, from.Id)
+	if err != nil {
+		return err
+	}
+	intoScores, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, into.Id)
+	if err != nil {
+		return err
+	}
+	fromTimes, err := r.ratingTimes(tx, from.Id)
+	if err != nil {
+		return err
+	}
+	intoTimes, err := r.ratingTimes(tx, into.Id)
+	if err != nil {
+		return err
+	}
+
+	for itemId, score := range fromScores {
+		if current, rated := intoScores[itemId]; rated && current != score {
+			switch policy {
+			case KeepTarget:
+				continue
+			case NewestWins:
+				if !fromTimes[itemId].After(intoTimes[itemId]) {
+					continue
+				}
+			}
+		}
+		// Keep the time the source rated the item, so the moved rating
+		// does not look new to decay or to later merges
+		if err := r.setRatingAt(tx, into, &Item{Id: itemId}, score, fromTimes[itemId]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeImplicit adds the source's implicit preference strengths to the
+// target's.
+func (r *Recommender) mergeImplicit(tx namespace, from, into *User) error {
+	strengths, err := r.implicitStrengths(tx, userImplicitBucketName, from.Id)
+	if err != nil {
+		return err
+	}
+	for itemId, strength := range strengths {
+		current, err := r.implicitStrength(tx, into.Id, itemId)
+		if err != nil {
+			return err
+		}
+		data, err := r.codec.Marshal(current + strength)
+		if err != nil {
+			return err
+		}
+		if err := putNested(tx, userImplicitBucketName, into.Id, itemId, data); err != nil {
+			return err
+		}
+		if err := putNested(tx, itemImplicitBucketName, itemId, into.Id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeImpressions adds the source's impression counts to the target's. Item
+// totals already include both.
+func (r *Recommender) mergeImpressions(tx namespace, from, into *User) error {
+	for itemId := range setMembers(tx, impressionBucketName, from.Id) {
+		source, err := r.impressions(tx, from.Id, itemId)
+		if err != nil {
+			return err
+		}
+		target, err := r.impressions(tx, into.Id, itemId)
+		if err != nil {
+			return err
+		}
+		target.Shown += source.Shown
+		target.Clicked += source.Clicked
+		target.Ignored += source.Ignored
+		data, err := r.codec.Marshal(target)
+		if err != nil {
+			return err
+		}
+		if err := putNested(tx, impressionBucketName, into.Id, itemId, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package recommender
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// migrations upgrade the database file one schema version at a time:
+// migrations[i] upgrades a file of version i to version i+1. Files written
+// before the schema version was recorded are version 0. Append new steps to
+// the end; never reorder or remove them. Steps from version 4 on must upgrade
+// every tenant under tenants/ as well as the default tenant.
+var migrations = []func(tx *bolt.Tx) error{
+	// 0 -> 1: ID sets, similarity and suggestions move to nested buckets
+	migrateNestedBuckets,
+	// 1 -> 2: the codec of stored values is recorded; until now it was JSON
+	recordJSONCodec,
+	// 2 -> 3: ratings are logged; existing ratings are logged without a time
+	seedRatingLog,
+	// 3 -> 4: users and items are indexed by external ID and name
+	indexNames,
+	// 4 -> 5: items are indexed by attribute
+	indexAttributes,
+}
+
+// schemaVersion is the version of the layout this package reads and writes.
+var schemaVersion = uint64(len(migrations))
+
+var schemaVersionKey = []byte("schemaVersion")
+
+// SchemaVersionError is returned when opening a database file written by a
+// newer version of this package, or, with WithReadOnly, by an older one.
+type SchemaVersionError struct {
+	Version   uint64
+	Supported uint64
+}
+
+// Error represents a SchemaVersionError as a string
+func (e *SchemaVersionError) Error() string {
+	if e.Version < e.Supported {
+		return fmt.Sprintf("database schema version %d is older than supported version %d and must be upgraded", e.Version, e.Supported)
+	}
+	return fmt.Sprintf("database schema version %d is newer than supported version %d", e.Version, e.Supported)
+}
+
+// getSchemaVersion reads the schema version recorded in the meta bucket, or 0
+// if there is none.
+func getSchemaVersion(tx *bolt.Tx) uint64 {
+	metaBucket := tx.Bucket([]byte(metaBucketName))
+	if metaBucket == nil {
+		return 0
+	}
+	data := metaBucket.Get(schemaVersionKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// putSchemaVersion records the schema version in the meta bucket.
+func putSchemaVersion(tx *bolt.Tx, version uint64) error {
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, version)
+	return metaBucket.Put(schemaVersionKey, data)
+}
+
+// migrate brings the database file up to the current schema version. A new
+// file is stamped with the current version; an older file is upgraded one
+// step per transaction, so an interrupted upgrade resumes where it stopped.
+// Files from a newer version are refused before anything is written.
+func migrate(db *bolt.DB) error {
+	for {
+		var done bool
+		if err := db.Update(func(tx *bolt.Tx) error {
+			version := getSchemaVersion(tx)
+			switch {
+			case version > schemaVersion:
+				return &SchemaVersionError{Version: version, Supported: schemaVersion}
+			case version == schemaVersion:
+				done = true
+				return nil
+			case tx.Bucket([]byte(metaBucketName)) == nil && tx.Bucket([]byte(userBucketName)) == nil:
+				// Nothing has been written yet
+				done = true
+				return putSchemaVersion(tx, schemaVersion)
+			}
+			if err := migrations[version](tx); err != nil {
+				return err
+			}
+			return putSchemaVersion(tx, version+1)
+		}); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package recommender
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures a Recommender on creation.
+type Option func(*Recommender)
+
+// WithPath sets the path of the database file, which defaults to
+// recommender.db in the working directory.
+func WithPath(path string) Option {
+	return func(r *Recommender) {
+		r.path = path
+	}
+}
+
+// WithNeighborhood sets which neighbors contribute to suggestions.
+func WithNeighborhood(neighborhood Neighborhood) Option {
+	return func(r *Recommender) {
+		r.neighborhood = neighborhood
+	}
+}
+
+// WithReadOnly opens the database file for reading only, so that inspecting
+// it, as with Check or Export, changes nothing. The file is not upgraded, not
+// re-encoded, and stale suggestions are not recomputed; a file of an older
+// schema version is refused with a *SchemaVersionError. WithCodec is ignored,
+// and every write fails.
+func WithReadOnly() Option {
+	return func(r *Recommender) {
+		r.readOnly = true
+	}
+}
+
+// WithCodec sets how stored values are encoded. New files default to
+// BinaryCodec; existing files keep the codec they were written with unless
+// another is given here, in which case they are re-encoded when opened.
+func WithCodec(codec Codec) Option {
+	return func(r *Recommender) {
+		r.codec = codec
+	}
+}
+
+// WithClock sets the source of the times recorded with ratings, which
+// defaults to time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(r *Recommender) {
+		r.clock = clock
+	}
+}
+
+// WithDecay sets how much older ratings are discounted in user similarity,
+// suggestions and predictions. By default, ratings do not decay.
+func WithDecay(decay Decay) Option {
+	return func(r *Recommender) {
+		r.decay = decay
+	}
+}
+
+// WithEventWeights sets how much each type of implicit feedback adds to a
+// pair's preference strength. Event types missing from weights cannot be
+// recorded.
+func WithEventWeights(weights map[EventType]float32) Option {
+	return func(r *Recommender) {
+		r.eventWeights = weights
+	}
+}
+
+// WithSuppression sets how suggestions the user keeps ignoring are demoted.
+// By default, nothing is demoted.
+func WithSuppression(suppression Suppression) Option {
+	return func(r *Recommender) {
+		r.suppression = suppression
+	}
+}
+
+// WithLogger sets where the Recommender logs rating writes, recomputations,
+// missing references and storage errors. By default, nothing is logged.
+// Tenants log to their parent's logger, with a tenant attribute, unless given
+// their own.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Recommender) {
+		if logger == nil {
+			logger = discardLogger
+		}
+		r.logger = logger
+	}
+}
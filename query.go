@@ -0,0 +1,153 @@
+package recommender
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// SuggestionQuery selects a page of a user's suggestions.
+type SuggestionQuery struct {
+	// Filter is a filter expression over item IDs and attributes, such as
+	// `state = "Colorado" and season != "winter"`. Empty matches every item.
+	Filter string
+	// Limit is the most suggestions returned. If it is not positive, every
+	// matching suggestion is returned.
+	Limit int
+	// Cursor continues from the page whose Next it is. Empty starts from the
+	// first page.
+	Cursor string
+}
+
+// SuggestionPage is a page of suggestions, ranked by index.
+type SuggestionPage struct {
+	Suggestions []Suggestion `json:"suggestions"`
+	// Next is the cursor of the following page, or empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// QuerySuggestions returns the user's suggestions that match the query's
+// filter, ranked by index and then by item ID. Rules apply as they do in
+// GetTopSuggestions: Cap rules limit the suggestions per category, counting
+// pinned items, and Pin rules place their items if they match the filter.
+// The filter and rules are applied to the whole ranking before the page is
+// cut, so a full page is returned as long as enough suggestions match.
+// Cursors mark a position in the ranking rather than an offset, so pages stay
+// consistent when suggestions before the cursor change.
+func (r *Recommender) QuerySuggestions(user *User, query SuggestionQuery) (*SuggestionPage, error) {
+	filter, err := parseFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+	var after *Suggestion
+	if query.Cursor != "" {
+		if after, err = decodeCursor(query.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	suggestionMap, err := r.GetSuggestions(user)
+	if err != nil {
+		return nil, err
+	}
+	var rules ruleSet
+	var pinned []Suggestion
+	var positions []int
+	if err := r.view(func(tx namespace) error {
+		var err error
+		if rules, err = r.getRules(tx); err != nil {
+			return err
+		}
+		pinned, positions, err = r.pinnedSuggestions(tx, user, rules, suggestionMap, r.clock())
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	// Keep the pins that match the filter; they are placed last
+	isPinned := make(map[string]bool)
+	var matchingPins []Suggestion
+	var matchingPositions []int
+	for i, suggestion := range pinned {
+		if filter.matches(&suggestion.Item) {
+			isPinned[suggestion.Item.Id] = true
+			matchingPins = append(matchingPins, suggestion)
+			matchingPositions = append(matchingPositions, positions[i])
+		}
+	}
+
+	var matches []Suggestion
+	for _, suggestion := range suggestionMap {
+		if !isPinned[suggestion.Item.Id] && filter.matches(&suggestion.Item) {
+			matches = append(matches, suggestion)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return ranksBefore(matches[i], matches[j])
+	})
+	var ranking []Suggestion
+	for _, suggestion := range matches {
+		if !rules.capped(&suggestion.Item, append(matchingPins[:len(matchingPins):len(matchingPins)], ranking...)) {
+			ranking = append(ranking, suggestion)
+		}
+	}
+	ranking = placePins(ranking, matchingPins, matchingPositions)
+
+	// Continue after the cursor's item or, if it is gone, from the first
+	// ranked suggestion after its position
+	if after != nil {
+		start, found := len(ranking), false
+		for i, suggestion := range ranking {
+			if suggestion.Item.Id == after.Item.Id {
+				start, found = i+1, true
+				break
+			}
+		}
+		if !found {
+			for i, suggestion := range ranking {
+				if !isPinned[suggestion.Item.Id] && ranksBefore(*after, suggestion) {
+					start = i
+					break
+				}
+			}
+		}
+		ranking = ranking[start:]
+	}
+
+	page := &SuggestionPage{Suggestions: ranking}
+	if query.Limit > 0 && len(ranking) > query.Limit {
+		page.Suggestions = ranking[:query.Limit]
+		page.Next = encodeCursor(page.Suggestions[query.Limit-1])
+	}
+	return page, nil
+}
+
+// ranksBefore reports whether suggestion a ranks before b: by index,
+// descending, and then by item ID.
+func ranksBefore(a, b Suggestion) bool {
+	if a.Index != b.Index {
+		return a.Index > b.Index
+	}
+	return a.Item.Id < b.Item.Id
+}
+
+// encodeCursor encodes the position of a suggestion in the ranking: its index
+// and its item ID.
+func encodeCursor(suggestion Suggestion) string {
+	data := make([]byte, 4, 4+len(suggestion.Item.Id))
+	binary.BigEndian.PutUint32(data, math.Float32bits(float32(suggestion.Index)))
+	data = append(data, suggestion.Item.Id...)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes a cursor into a suggestion holding just its position.
+func decodeCursor(cursor string) (*Suggestion, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) < 4 {
+		return nil, invalidInput("cursor %q", cursor)
+	}
+	suggestion := &Suggestion{Index: SuggestionIndex(math.Float32frombits(binary.BigEndian.Uint32(data)))}
+	suggestion.Item.Id = string(data[4:])
+	return suggestion, nil
+}
@@ -1,6 +1,9 @@
 package recommender
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Score int
 
@@ -10,8 +13,9 @@ const (
 )
 
 type Rating struct {
-	Item  Item  `json:"item"`
-	Score Score `json:"score"`
+	Item  Item      `json:"item"`
+	Score Score     `json:"score"`
+	Time  time.Time `json:"time"`
 }
 
 // String represents an Item as a string
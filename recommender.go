@@ -1,15 +1,31 @@
 package recommender
 
 import (
-	"encoding/json"
-	"log"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 type Recommender struct {
-	db *bolt.DB
+	db           *bolt.DB
+	path         string
+	neighborhood Neighborhood
+	codec        Codec
+	clock        func() time.Time
+	decay        Decay
+	eventWeights map[EventType]float32
+	suppression  Suppression
+	logger       *slog.Logger
+	readOnly     bool
+	// tenant is the name of the tenant whose data the Recommender reads and
+	// writes, or "" for the default tenant.
+	tenant string
 }
 
 const (
@@ -23,114 +39,179 @@ const (
 	userSimilarityBucketName string = "userSimilarity"
 	itemSimilarityBucketName string = "itemSimilarity"
 	suggestionBucketName     string = "suggestionBucket"
+
+	staleSuggestionsBucketName string = "staleSuggestions"
+	metaBucketName             string = "meta"
+	ratingLogBucketName        string = "ratingLog"
+	userRatingLogBucketName    string = "userRatingLog"
+	itemRatingLogBucketName    string = "itemRatingLog"
+	userImplicitBucketName     string = "userImplicit"
+	itemImplicitBucketName     string = "itemImplicit"
+	hiddenBucketName           string = "hidden"
+	impressionBucketName       string = "impressions"
+	itemImpressionBucketName   string = "itemImpressions"
+	ruleBucketName             string = "rules"
+	userExternalIdBucketName   string = "userExternalId"
+	itemExternalIdBucketName   string = "itemExternalId"
+	userNameBucketName         string = "userName"
+	itemNameBucketName         string = "itemName"
+	itemAttributeBucketName    string = "itemAttribute"
+	tenantBucketName           string = "tenants"
 )
 
-// NewRecommender returns a new Recommender. The database is opened and buckets are created.
-func NewRecommender() (*Recommender, error) {
+// bucketNames are the buckets holding a tenant's data.
+var bucketNames = []string{
+	userBucketName,
+	itemBucketName,
+	userLikesBucketName,
+	itemLikesBucketName,
+	userDislikesBucketName,
+	itemDislikesBucketName,
+	userSimilarityBucketName,
+	itemSimilarityBucketName,
+	suggestionBucketName,
+	staleSuggestionsBucketName,
+	ratingLogBucketName,
+	userRatingLogBucketName,
+	itemRatingLogBucketName,
+	userImplicitBucketName,
+	itemImplicitBucketName,
+	hiddenBucketName,
+	impressionBucketName,
+	itemImpressionBucketName,
+	ruleBucketName,
+	userExternalIdBucketName,
+	itemExternalIdBucketName,
+	userNameBucketName,
+	itemNameBucketName,
+	itemAttributeBucketName,
+}
+
+// createBuckets creates any of a tenant's buckets that do not exist.
+func createBuckets(ns namespace) error {
+	for _, bucketName := range bucketNames {
+		if _, err := ns.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewRecommender returns a new Recommender configured by the given options.
+// The database is opened, upgraded to the current schema version, and
+// buckets are created. A *SchemaVersionError is returned if the database was
+// written by a newer version, and a *StorageError if it cannot be opened.
+func NewRecommender(opts ...Option) (*Recommender, error) {
+	r := &Recommender{path: dbName, clock: time.Now, eventWeights: defaultEventWeights, logger: discardLogger}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.readOnly {
+		return r.openReadOnly()
+	}
+
 	// Create key/value store for ratings data
-	db, err := bolt.Open(dbName, 0600, nil)
+	db, err := bolt.Open(r.path, 0600, nil)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
+	}
+	// Upgrade files written by earlier versions
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, storageError(err)
 	}
 	// Create buckets
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte(userBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(itemBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(itemLikesBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(userLikesBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(itemDislikesBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(userDislikesBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(userSimilarityBucketName)); err != nil {
+		if _, err := tx.CreateBucketIfNotExists([]byte(tenantBucketName)); err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(itemSimilarityBucketName)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(suggestionBucketName)); err != nil {
-			return err
-		}
-		return nil
+		return createBuckets(tx)
 	}); err != nil {
+		db.Close()
+		return nil, storageError(err)
+	}
+	r.db = db
+
+	// Settle how stored values are encoded
+	if err := r.openCodec(); err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &Recommender{db}, nil
-}
 
-// Close closes the Recommender's store connection. Deferring a call to this method
-// is recommended on creation of a Recommender.
-func (r *Recommender) Close() {
-	err := r.db.Close()
-	if err != nil {
-		log.Panic(err)
+	// Recompute suggestions left stale by an interrupted rating
+	if err := r.recoverSuggestions(); err != nil {
+		db.Close()
+		return nil, err
 	}
-}
 
-// GetLikedItems gets Items liked by the given User.
-func (r *Recommender) GetLikedItems(user *User) (map[string]Item, error) {
-	items := make(map[string]Item)
-	itemIds := make(map[string]bool)
+	return r, nil
+}
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		// Get item IDs
-		userLikesBucket := tx.Bucket([]byte(userLikesBucketName))
-		data := userLikesBucket.Get([]byte(user.Id))
-		if data == nil {
-			return nil
-		}
-		if err := json.Unmarshal(data, &itemIds); err != nil {
-			return err
+// openReadOnly opens the database file for WithReadOnly. The file must be of
+// the current schema version, and is read with the codec it records.
+func (r *Recommender) openReadOnly() (*Recommender, error) {
+	db, err := bolt.Open(r.path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if version := getSchemaVersion(tx); version != schemaVersion {
+			return &SchemaVersionError{Version: version, Supported: schemaVersion}
 		}
-		// Get items by ID
-		for id, _ := range itemIds {
-			item, err := r.getItem(id)
-			if err != nil {
-				log.Printf("WARNING: Cannot find item ID=%v\n", id)
-				continue
-			}
-			items[id] = *item
+		codec, exists := codecs[getCodecName(tx)]
+		if !exists {
+			return fmt.Errorf("database is encoded with unknown codec %q", getCodecName(tx))
 		}
+		r.codec = codec
 		return nil
 	}); err != nil {
-		return nil, err
+		db.Close()
+		return nil, storageError(err)
 	}
+	r.db = db
+	return r, nil
+}
 
-	return items, nil
+// Close closes the Recommender's store connection. Deferring a call to this method
+// is recommended on creation of a Recommender. Operations on a closed
+// Recommender return ErrClosed. Closing a tenant's Recommender does nothing;
+// the file is closed with the Recommender it came from.
+func (r *Recommender) Close() error {
+	if r.tenant != "" {
+		return nil
+	}
+	if err := r.db.Close(); err != nil {
+		return &StorageError{Err: err}
+	}
+	return nil
+}
+
+// GetLikedItems gets Items liked by the given User.
+func (r *Recommender) GetLikedItems(user *User) (map[string]Item, error) {
+	return r.getItemSet(userLikesBucketName, user.Id)
 }
 
 // GetDislikedItems gets Items disliked by the given User.
 func (r *Recommender) GetDislikedItems(user *User) (map[string]Item, error) {
+	return r.getItemSet(userDislikesBucketName, user.Id)
+}
+
+// getItemSet gets the Items in the set stored under key in the named bucket.
+func (r *Recommender) getItemSet(bucketName, key string) (map[string]Item, error) {
 	items := make(map[string]Item)
-	itemIds := make(map[string]bool)
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		// Get item IDs
-		userDislikesBucket := tx.Bucket([]byte(userDislikesBucketName))
-		data := userDislikesBucket.Get([]byte(user.Id))
-		if data == nil {
-			return nil
-		}
-		if err := json.Unmarshal(data, &itemIds); err != nil {
-			return err
-		}
+	if err := r.view(func(tx namespace) error {
 		// Get items by ID
-		for id, _ := range itemIds {
+		for id := range setMembers(tx, bucketName, key) {
 			item, err := r.getItem(id)
-			if err != nil {
-				log.Printf("WARNING: Cannot find item ID=%v\n", id)
+			if err == ErrItemNotFound {
+				r.logger.Warn("missing item", "item", id, "bucket", bucketName, "key", key)
 				continue
 			}
+			if err != nil {
+				return err
+			}
 			items[id] = *item
 		}
 		return nil
@@ -141,18 +222,16 @@ func (r *Recommender) GetDislikedItems(user *User) (map[string]Item, error) {
 	return items, nil
 }
 
-// getItem retrieves an Item by ID.
+// getItem retrieves an Item by ID, or returns ErrItemNotFound.
 func (r *Recommender) getItem(id string) (*Item, error) {
 	var item Item
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		itemBucket := tx.Bucket([]byte(itemBucketName))
-		if data := itemBucket.Get([]byte(id)); data != nil {
-			if err := json.Unmarshal(data, &item); err != nil {
-				return err
-			}
+	if err := r.view(func(tx namespace) error {
+		data := tx.Bucket([]byte(itemBucketName)).Get([]byte(id))
+		if data == nil {
+			return ErrItemNotFound
 		}
-		return nil
+		return r.codec.Unmarshal(data, &item)
 	}); err != nil {
 		return nil, err
 	}
@@ -160,60 +239,47 @@ func (r *Recommender) getItem(id string) (*Item, error) {
 	return &item, nil
 }
 
-// GetUsersWhoLike retrieves the collection of users who like the given Item.
-func (r *Recommender) GetUsersWhoLike(item *Item) (map[string]User, error) {
-	users := make(map[string]User)
-	userIds := make(map[string]bool)
-
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		itemLikeBucket := tx.Bucket([]byte(itemLikesBucketName))
-		// Get user IDs
-		data := itemLikeBucket.Get([]byte(item.Id))
-		if data == nil {
-			return nil
-		}
-		if err := json.Unmarshal(data, &userIds); err != nil {
-			return err
-		}
-		// Get users by ID
-		for id, _ := range userIds {
-			user, err := r.getUser(id)
-			if err != nil {
-				log.Printf("WARNING: Cannot find user ID=%v\n", id)
-				continue
-			}
-			users[id] = *user
-		}
-		return nil
-	}); err != nil {
-		return nil, err
+// storedItem returns the stored copy of the item, which holds its current
+// name and attributes, or the item itself if it is not stored.
+func (r *Recommender) storedItem(tx namespace, item *Item) (Item, error) {
+	data := tx.Bucket([]byte(itemBucketName)).Get([]byte(item.Id))
+	if data == nil {
+		return *item, nil
 	}
+	// Decode into a fresh Item, since decoding JSON into a copy would merge
+	// into the caller's Attributes map
+	var stored Item
+	if err := r.codec.Unmarshal(data, &stored); err != nil {
+		return Item{}, err
+	}
+	return stored, nil
+}
 
-	return users, nil
+// GetUsersWhoLike retrieves the collection of users who like the given Item.
+func (r *Recommender) GetUsersWhoLike(item *Item) (map[string]User, error) {
+	return r.getUserSet(itemLikesBucketName, item.Id)
 }
 
 // GetUsersWhoDislike retrieves the collection of users who dislike the given Item.
 func (r *Recommender) GetUsersWhoDislike(item *Item) (map[string]User, error) {
+	return r.getUserSet(itemDislikesBucketName, item.Id)
+}
+
+// getUserSet gets the Users in the set stored under key in the named bucket.
+func (r *Recommender) getUserSet(bucketName, key string) (map[string]User, error) {
 	users := make(map[string]User)
-	userIds := make(map[string]bool)
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		itemDislikeBucket := tx.Bucket([]byte(itemDislikesBucketName))
-		// Get user IDs
-		data := itemDislikeBucket.Get([]byte(item.Id))
-		if data == nil {
-			return nil
-		}
-		if err := json.Unmarshal(data, &userIds); err != nil {
-			return err
-		}
+	if err := r.view(func(tx namespace) error {
 		// Get users by ID
-		for id, _ := range userIds {
+		for id := range setMembers(tx, bucketName, key) {
 			user, err := r.getUser(id)
-			if err != nil {
-				log.Printf("WARNING: Cannot find user ID=%v\n", id)
+			if err == ErrUserNotFound {
+				r.logger.Warn("missing user", "user", id, "bucket", bucketName, "key", key)
 				continue
 			}
+			if err != nil {
+				return err
+			}
 			users[id] = *user
 		}
 		return nil
@@ -227,63 +293,68 @@ func (r *Recommender) GetUsersWhoDislike(item *Item) (map[string]User, error) {
 // GetUsersWhoRated retrieves the collection of users who rated the given Item.
 func (r *Recommender) GetUsersWhoRated(item *Item) (map[string]User, error) {
 	userCh := make(chan User)
+	errCh := make(chan error, 2)
 	var wg sync.WaitGroup
 
 	// Retrieve users who like the item and pipe them into the channel.
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		users, err := r.GetUsersWhoLike(item)
 		if err != nil {
+			errCh <- err
 			return
 		}
 		for _, user := range users {
 			userCh <- user
 		}
-		wg.Done()
 	}()
 
 	// Retrieve users who dislike the item and pipe them into the channel.
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		users, err := r.GetUsersWhoDislike(item)
 		if err != nil {
+			errCh <- err
 			return
 		}
 		for _, user := range users {
 			userCh <- user
 		}
-		wg.Done()
 	}()
 
 	// Wait for the like and dislike goroutines to finish, then close the
-	// user channel
+	// error and user channels
 	go func() {
 		wg.Wait()
+		close(errCh)
 		close(userCh)
 	}()
 
 	// As users are sent through the channel, build out map. Return map when
-	// channel closes.
+	// channel closes, unless either goroutine failed.
 	users := make(map[string]User)
 	for user := range userCh {
 		users[user.Id] = user
 	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
 
 	return users, nil
 }
 
-// getUser retrieves a User by ID.
+// getUser retrieves a User by ID, or returns ErrUserNotFound.
 func (r *Recommender) getUser(id string) (*User, error) {
 	var user User
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		userBucket := tx.Bucket([]byte(userBucketName))
-		if data := userBucket.Get([]byte(id)); data != nil {
-			if err := json.Unmarshal(data, &user); err != nil {
-				return err
-			}
+	if err := r.view(func(tx namespace) error {
+		data := tx.Bucket([]byte(userBucketName)).Get([]byte(id))
+		if data == nil {
+			return ErrUserNotFound
 		}
-		return nil
+		return r.codec.Unmarshal(data, &user)
 	}); err != nil {
 		return nil, err
 	}
@@ -294,61 +365,31 @@ func (r *Recommender) getUser(id string) (*User, error) {
 // Like records a user liking an item. If the user already likes the item,
 // nothing happens. Only if the recording fails will this return an error.
 func (r *Recommender) Like(user *User, item *Item) error {
-	// Add user if record does not already exist
-	if err := r.addUser(user); err != nil {
-		return err
-	}
-
-	// Add item if records does not already exist
-	if err := r.addItem(item); err != nil {
-		return err
-	}
-
-	// Add like (bi-directional) if records do not already exist.
-	if err := r.addLike(user, item); err != nil {
-		return err
-	}
-
-	// Update similarity index
-	if err := r.UpdateSimilarity(user); err != nil {
-		return err
-	}
-
-	// Update suggestions
-	// TODO
-	if err := r.UpdateSuggestions(user); err != nil {
-		return err
-	}
-
-	return nil
+	return r.rate(user, item, r.addLike)
 }
 
 // Dislike records a user disliking an item. If the user already dislikes the
 // item, nothing happens. If the user likes the item, the like is removed first.
 // Only if the recording fails will this return an error.
 func (r *Recommender) Dislike(user *User, item *Item) error {
-	// Add user if record does not already exist
-	if err := r.addUser(user); err != nil {
-		return err
-	}
-
-	// Add item if records does not already exist
-	if err := r.addItem(item); err != nil {
-		return err
-	}
+	return r.rate(user, item, r.addDislike)
+}
 
-	// Add like (bi-directional) if records do not already exist.
-	if err := r.addDislike(user, item); err != nil {
-		return err
-	}
+// Unrate removes a user's like or dislike of an item. If the user has not
+// rated the item, nothing happens. Only if the removal fails will this return
+// an error.
+func (r *Recommender) Unrate(user *User, item *Item) error {
+	return r.rate(user, item, r.removeRating)
+}
 
-	// Update similarity index
-	if err := r.UpdateSimilarity(user); err != nil {
+// rate records a rating with the given add function, as record does, and
+// then recomputes the user's suggestions.
+func (r *Recommender) rate(user *User, item *Item, add func(namespace, *User, *Item) error) error {
+	if err := r.record(user, item, add); err != nil {
 		return err
 	}
 
 	// Update suggestions
-	// TODO
 	if err := r.UpdateSuggestions(user); err != nil {
 		return err
 	}
@@ -356,273 +397,234 @@ func (r *Recommender) Dislike(user *User, item *Item) error {
 	return nil
 }
 
-// addUser inserts a record in the user bucket if it does not already exist.
-func (r *Recommender) addUser(user *User) error {
-	err := r.db.Update(func(tx *bolt.Tx) error {
-		userBucket := tx.Bucket([]byte(userBucketName))
-		// Return early if user already exists
-		if data := userBucket.Get([]byte(user.Id)); data != nil {
-			return nil
+// record writes a rating or feedback with the given add function. The change
+// and its bookkeeping are written in a single transaction, so that either all
+// or none of it is saved, and the user's suggestions are marked stale until
+// they are recomputed. Stale suggestions left by a crash are recomputed when
+// the database is next opened.
+func (r *Recommender) record(user *User, item *Item, add func(namespace, *User, *Item) error) error {
+	return r.update(func(tx namespace) error {
+		// Add user if record does not already exist
+		if err := r.addUser(tx, user); err != nil {
+			return err
 		}
-		// Write JSON encoding of user to DB
-		data, err := json.Marshal(user)
-		if err != nil {
+
+		// Add item if records does not already exist
+		if err := r.addItem(tx, item); err != nil {
 			return err
 		}
-		if err := userBucket.Put([]byte(user.Id), data); err != nil {
+
+		// Add rating (bi-directional) if records do not already exist.
+		// Similarity records are updated along with it.
+		if err := add(tx, user, item); err != nil {
 			return err
 		}
-		// log.Printf("User %s added.\n", user.Name)
-		return nil
+
+		// Mark suggestions stale until they are recomputed
+		return markSuggestionsStale(tx, user.Id)
 	})
+}
 
+// markSuggestionsStale records that the user's suggestions no longer reflect
+// the ratings. Each mark is unique, so that UpdateSuggestions only clears the
+// mark it started from.
+func markSuggestionsStale(tx namespace, userId string) error {
+	bucket := tx.Bucket([]byte(staleSuggestionsBucketName))
+	seq, err := bucket.NextSequence()
 	if err != nil {
 		return err
 	}
-	return nil
+	mark := make([]byte, 8)
+	binary.BigEndian.PutUint64(mark, seq)
+	return bucket.Put([]byte(userId), mark)
 }
 
-// addItem inserts a record in the item bucket if it does not already exist.
-func (r *Recommender) addItem(item *Item) error {
-	err := r.db.Update(func(tx *bolt.Tx) error {
-		itemBucket := tx.Bucket([]byte(itemBucketName))
-		// Return early if item already exists
-		if data := itemBucket.Get([]byte(item.Id)); data != nil {
+// UpdateStaleSuggestions recomputes the suggestions of every user whose
+// suggestions are marked stale, such as users who recorded implicit feedback
+// since. Run it periodically when feedback is recorded with Record.
+func (r *Recommender) UpdateStaleSuggestions() error {
+	return r.recoverSuggestions()
+}
+
+// recoverSuggestions recomputes the suggestions of every user whose
+// suggestions are marked stale.
+func (r *Recommender) recoverSuggestions() error {
+	var userIds []string
+	if err := r.view(func(tx namespace) error {
+		return tx.Bucket([]byte(staleSuggestionsBucketName)).ForEach(func(key, _ []byte) error {
+			userIds = append(userIds, string(key))
 			return nil
-		}
-		// Write JSON encoding of item to DB
-		data, err := json.Marshal(item)
-		if err != nil {
-			return err
-		}
-		if err := itemBucket.Put([]byte(item.Id), data); err != nil {
+		})
+	}); err != nil {
+		return err
+	}
+
+	if len(userIds) > 0 {
+		r.logger.Info("recovering stale suggestions", "users", len(userIds))
+	}
+	for _, userId := range userIds {
+		if err := r.UpdateSuggestions(&User{Id: userId}); err != nil {
 			return err
 		}
-		// log.Printf("Item %s added.\n", item.Name)
+	}
+	return nil
+}
+
+// addUser inserts a record in the user bucket if it does not already exist.
+func (r *Recommender) addUser(tx namespace, user *User) error {
+	userBucket := tx.Bucket([]byte(userBucketName))
+	// Return early if user already exists
+	if data := userBucket.Get([]byte(user.Id)); data != nil {
+		return nil
+	}
+	// Write encoding of user to DB
+	data, err := r.codec.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if err := userBucket.Put([]byte(user.Id), data); err != nil {
+		return err
+	}
+	return putIndexEntries(tx, userExternalIdBucketName, userNameBucketName, user.Id, "", "", user.ExternalId, user.Name)
+}
+
+// addItem inserts a record in the item bucket if it does not already exist.
+func (r *Recommender) addItem(tx namespace, item *Item) error {
+	itemBucket := tx.Bucket([]byte(itemBucketName))
+	// Return early if item already exists
+	if data := itemBucket.Get([]byte(item.Id)); data != nil {
 		return nil
+	}
+	// Write encoding of item to DB
+	data, err := r.codec.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err := itemBucket.Put([]byte(item.Id), data); err != nil {
+		return err
+	}
+	if err := putAttributeEntries(tx, item.Id, nil, item.Attributes); err != nil {
+		return err
+	}
+	return putIndexEntries(tx, itemExternalIdBucketName, itemNameBucketName, item.Id, "", "", item.ExternalId, item.Name)
+}
+
+// SaveItem inserts or replaces the record for the given Item. Use it to
+// change an Item's name, attributes or external ID after the Item has been
+// rated. An error is returned if the external ID belongs to another Item.
+func (r *Recommender) SaveItem(item *Item) error {
+	return r.update(func(tx namespace) error {
+		return r.saveItem(tx, item)
 	})
+}
 
+// saveItem writes the item's record, replacing the index entries of the
+// record it replaces.
+func (r *Recommender) saveItem(tx namespace, item *Item) error {
+	itemBucket := tx.Bucket([]byte(itemBucketName))
+	var previous Item
+	if data := itemBucket.Get([]byte(item.Id)); data != nil {
+		if err := r.codec.Unmarshal(data, &previous); err != nil {
+			return err
+		}
+	}
+	if err := putIndexEntries(tx, itemExternalIdBucketName, itemNameBucketName, item.Id, previous.ExternalId, previous.Name, item.ExternalId, item.Name); err != nil {
+		return err
+	}
+	if err := putAttributeEntries(tx, item.Id, previous.Attributes, item.Attributes); err != nil {
+		return err
+	}
+	data, err := r.codec.Marshal(item)
 	if err != nil {
 		return err
 	}
-	return nil
+	return itemBucket.Put([]byte(item.Id), data)
 }
 
 // addLike inserts records in the userLikes and itemLikes buckets for the User
 // and Item. If a dislike exists, both such records are deleted. If the like
 // records already exists, no action is taken.
-func (r *Recommender) addLike(user *User, item *Item) error {
-	// Add item to user's likes
-	if err := r.db.Update(func(tx *bolt.Tx) error {
-		itemIds := make(map[string]bool)
-		userLikesBucket := tx.Bucket([]byte(userLikesBucketName))
-
-		// Find user's liked items
-		if data := userLikesBucket.Get([]byte(user.Id)); data != nil {
-			// Get user's liked item IDs
-			if err := json.Unmarshal(data, &itemIds); err != nil {
-				return err
-			}
-			// If user already likes item, return early
-			if itemIds[item.Id] {
-				// log.Printf("Like by (%s, %s) already exists.\n", item.Name, user.Name)
-				return nil
-			}
-		}
-
-		// Add item to user's liked items
-		itemIds[item.Id] = true
-		data, err := json.Marshal(itemIds)
-		if err != nil {
-			return err
-		}
-		if err := userLikesBucket.Put([]byte(user.Id), data); err != nil {
-			return err
-		}
+func (r *Recommender) addLike(tx namespace, user *User, item *Item) error {
+	return r.setRating(tx, user, item, like)
+}
 
-		// Find user's disliked items
-		itemIds = make(map[string]bool)
-		userDislikesBucket := tx.Bucket([]byte(userDislikesBucketName))
-		if data := userDislikesBucket.Get([]byte(user.Id)); data != nil {
-			// Get user's disliked item IDs
-			if err := json.Unmarshal(data, &itemIds); err != nil {
-				return err
-			}
-			// If user dislikes item, remove the dislike
-			if itemIds[item.Id] {
-				delete(itemIds, item.Id)
-				data, err := json.Marshal(itemIds)
-				if err != nil {
-					return err
-				}
-				if err := userDislikesBucket.Put([]byte(user.Id), data); err != nil {
-					return err
-				}
-				// log.Printf("Disike (%s, %s) removed.\n", user.Name, item.Name)
-			}
-		}
+// addDislike inserts records in the userDislikes and itemDislikes buckets for
+// the User and Item. If a like exists, both such records are deleted. If the
+// dislike records already exists, no action is taken.
+func (r *Recommender) addDislike(tx namespace, user *User, item *Item) error {
+	return r.setRating(tx, user, item, dislike)
+}
 
-		userIds := make(map[string]bool)
-		itemLikesBucket := tx.Bucket([]byte(itemLikesBucketName))
-		// Find users who like item
-		if data := itemLikesBucket.Get([]byte(item.Id)); data != nil {
-			// Get item's liked-by user IDs
-			if err := json.Unmarshal(data, &userIds); err != nil {
-				return err
-			}
-			// If item already liked by user, return early
-			if userIds[user.Id] {
-				// log.Printf("Like (%s, %s) already exists.\n", user.Name, item.Name)
-				return nil
-			}
-		}
+// removeRating deletes the records of the User's like or dislike of the Item,
+// if any.
+func (r *Recommender) removeRating(tx namespace, user *User, item *Item) error {
+	return r.setRating(tx, user, item, 0)
+}
 
-		// Add user to item's liked-by
-		userIds[user.Id] = true
-		data, err = json.Marshal(userIds)
-		if err != nil {
-			return err
-		}
-		if err := itemLikesBucket.Put([]byte(item.Id), data); err != nil {
-			return err
-		}
+// setRating appends the change to the rating log, records the given score in
+// both directions, removes any other score, and updates the similarity
+// records of every pair the rating is part of. A zero score removes the
+// rating. Changes that leave the score as it was are not logged.
+func (r *Recommender) setRating(tx namespace, user *User, item *Item, score Score) error {
+	return r.setRatingAt(tx, user, item, score, r.clock())
+}
 
-		// Find users who dislike item
-		userIds = make(map[string]bool)
-		itemDislikesBucket := tx.Bucket([]byte(itemDislikesBucketName))
-		if data := itemDislikesBucket.Get([]byte(item.Id)); data != nil {
-			// Get item's liked item IDs
-			if err := json.Unmarshal(data, &userIds); err != nil {
-				return err
-			}
-			// If item dislikes item, remove the dislike
-			if userIds[user.Id] {
-				delete(userIds, user.Id)
-				data, err := json.Marshal(userIds)
-				if err != nil {
-					return err
-				}
-				if err := itemDislikesBucket.Put([]byte(user.Id), data); err != nil {
-					return err
-				}
-				// log.Printf("Dislike (%s, %s) removed.\n", user.Name, item.Name)
-			}
-		}
+// setRatingAt sets a rating as setRating does, but logs the change at the
+// given time rather than now, for ratings carried over from elsewhere.
+func (r *Recommender) setRatingAt(tx namespace, user *User, item *Item, score Score, at time.Time) error {
+	if score != like && score != dislike && score != 0 {
+		return ErrInvalidScore
+	}
 
-		// log.Printf("Like (%s, %s) added.\n", user.Name, item.Name)
+	// Remember the user's previous score, to update similarity records
+	previous, err := userScore(tx, user.Id, item.Id)
+	if err != nil {
+		return err
+	}
+	// If user already gave the score, return early
+	if previous == score {
 		return nil
+	}
+
+	// Log the change
+	if err := logRating(tx, r.codec, RatingEvent{
+		UserId: user.Id,
+		ItemId: item.Id,
+		Score:  score,
+		Time:   at,
 	}); err != nil {
 		return err
 	}
-	return nil
-}
 
-// addDislike inserts records in the userDislikes and itemDislikes buckets for
-// the User and Item. If a like exists, both such records are deleted. If the
-// dislike records already exists, no action is taken.
-func (r *Recommender) addDislike(user *User, item *Item) error {
-	// Add item to user's dislikes
-	if err := r.db.Update(func(tx *bolt.Tx) error {
-		itemIds := make(map[string]bool)
-		userDislikesBucket := tx.Bucket([]byte(userDislikesBucketName))
-
-		// Find user's disliked items
-		if data := userDislikesBucket.Get([]byte(user.Id)); data != nil {
-			// Get user's disliked item IDs
-			if err := json.Unmarshal(data, &itemIds); err != nil {
+	for bucketScore, bucketNames := range map[Score][2]string{
+		like:    {userLikesBucketName, itemLikesBucketName},
+		dislike: {userDislikesBucketName, itemDislikesBucketName},
+	} {
+		userBucketName, itemBucketName := bucketNames[0], bucketNames[1]
+		if bucketScore == score {
+			// Add rating (bi-directional)
+			if err := addToSet(tx, userBucketName, user.Id, item.Id); err != nil {
 				return err
 			}
-			// If user already dislikes item, return early
-			if itemIds[item.Id] {
-				// log.Printf("Dislike (%s, %s) already exists.\n", item.Name, user.Name)
-				return nil
-			}
-		}
-
-		// Add item to user's disliked items
-		itemIds[item.Id] = true
-		data, err := json.Marshal(itemIds)
-		if err != nil {
-			return err
-		}
-		if err := userDislikesBucket.Put([]byte(user.Id), data); err != nil {
-			return err
-		}
-
-		// Find user's liked items
-		itemIds = make(map[string]bool)
-		userLikesBucket := tx.Bucket([]byte(userLikesBucketName))
-		if data := userLikesBucket.Get([]byte(user.Id)); data != nil {
-			// Get user's liked item IDs
-			if err := json.Unmarshal(data, &itemIds); err != nil {
+			if err := addToSet(tx, itemBucketName, item.Id, user.Id); err != nil {
 				return err
 			}
-			// If user likes item, remove the like
-			if itemIds[item.Id] {
-				delete(itemIds, item.Id)
-				data, err := json.Marshal(itemIds)
-				if err != nil {
-					return err
-				}
-				if err := userLikesBucket.Put([]byte(user.Id), data); err != nil {
-					return err
-				}
-				// log.Printf("Like (%s, %s) removed.\n", user.Name, item.Name)
-			}
-		}
-
-		userIds := make(map[string]bool)
-		itemDislikesBucket := tx.Bucket([]byte(itemDislikesBucketName))
-		// Find users who dislike item
-		if data := itemDislikesBucket.Get([]byte(item.Id)); data != nil {
-			// Get item's disliked-by user IDs
-			if err := json.Unmarshal(data, &userIds); err != nil {
-				return err
-			}
-			// If item already disliked by user, return early
-			if userIds[user.Id] {
-				// log.Printf("Dislike (%s, %s) already exists.\n", user.Name, item.Name)
-				return nil
-			}
+			continue
 		}
-
-		// Add user to item's disliked-by
-		userIds[user.Id] = true
-		data, err = json.Marshal(userIds)
-		if err != nil {
+		// Remove other rating (bi-directional), if any
+		if err := deleteNested(tx, userBucketName, user.Id, item.Id); err != nil {
 			return err
 		}
-		if err := itemDislikesBucket.Put([]byte(item.Id), data); err != nil {
+		if err := deleteNested(tx, itemBucketName, item.Id, user.Id); err != nil {
 			return err
 		}
+	}
 
-		// Find users who like item
-		userIds = make(map[string]bool)
-		itemLikesBucket := tx.Bucket([]byte(itemLikesBucketName))
-		if data := itemLikesBucket.Get([]byte(item.Id)); data != nil {
-			// Get item's liked item IDs
-			if err := json.Unmarshal(data, &userIds); err != nil {
-				return err
-			}
-			// If item dislikes item, remove the dislike
-			if userIds[user.Id] {
-				delete(userIds, user.Id)
-				data, err := json.Marshal(userIds)
-				if err != nil {
-					return err
-				}
-				if err := itemLikesBucket.Put([]byte(user.Id), data); err != nil {
-					return err
-				}
-				// log.Printf("Like (%s, %s) removed.\n", user.Name, item.Name)
-			}
-		}
-
-		// log.Printf("Dislike (%s, %s) added.\n", user.Name, item.Name)
-		return nil
-	}); err != nil {
+	// Update the similarity records of every pair the rating is part of
+	if err := r.updateSimilarityRecords(tx, user.Id, item.Id, previous, score); err != nil {
 		return err
 	}
+	r.logger.Debug("rating written", "user", user.Id, "item", item.Id, "score", score, "previous", previous)
 	return nil
 }
 
@@ -630,14 +632,14 @@ func (r *Recommender) addDislike(user *User, item *Item) error {
 func (r *Recommender) GetUsers(startAt int, count int) ([]User, error) {
 	var users []User
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
+	if err := r.view(func(tx namespace) error {
 		userBucket := tx.Bucket([]byte(userBucketName))
 		cur := userBucket.Cursor()
 		i, c := 0, 0
 		for key, val := cur.First(); key != nil && c < count; key, val = cur.Next() {
 			if i >= startAt {
 				var u User
-				if err := json.Unmarshal(val, &u); err != nil {
+				if err := r.codec.Unmarshal(val, &u); err != nil {
 					return err
 				}
 				users = append(users, u)
@@ -656,14 +658,14 @@ func (r *Recommender) GetUsers(startAt int, count int) ([]User, error) {
 func (r *Recommender) GetItems(startAt int, count int) ([]Item, error) {
 	var items []Item
 
-	if err := r.db.View(func(tx *bolt.Tx) error {
+	if err := r.view(func(tx namespace) error {
 		itemBucket := tx.Bucket([]byte(itemBucketName))
 		cur := itemBucket.Cursor()
 		i, c := 0, 0
 		for key, val := cur.First(); key != nil && c < count; key, val = cur.Next() {
 			if i > startAt {
 				var i Item
-				if err := json.Unmarshal(val, &i); err != nil {
+				if err := r.codec.Unmarshal(val, &i); err != nil {
 					return err
 				}
 				items = append(items, i)
@@ -678,9 +680,12 @@ func (r *Recommender) GetItems(startAt int, count int) ([]Item, error) {
 	return items, nil
 }
 
-// channelRatings retrieves a collection of Items.
-func (r *Recommender) channelRatings(user *User) (<-chan Rating, error) {
+// channelRatings sends the user's ratings through the returned rating
+// channel, which is closed once all are sent. Errors are sent through the
+// error channel, which is closed before the rating channel.
+func (r *Recommender) channelRatings(user *User) (<-chan Rating, <-chan error) {
 	ratingCh := make(chan Rating)
+	errCh := make(chan error, 2)
 	var wg sync.WaitGroup
 
 	// Retrieve liked items, package them into Rating structs, and pipe
@@ -690,6 +695,7 @@ func (r *Recommender) channelRatings(user *User) (<-chan Rating, error) {
 		defer wg.Done()
 		items, err := r.GetLikedItems(user)
 		if err != nil {
+			errCh <- err
 			return
 		}
 		for _, item := range items {
@@ -707,6 +713,7 @@ func (r *Recommender) channelRatings(user *User) (<-chan Rating, error) {
 		defer wg.Done()
 		items, err := r.GetDislikedItems(user)
 		if err != nil {
+			errCh <- err
 			return
 		}
 		for _, item := range items {
@@ -718,13 +725,14 @@ func (r *Recommender) channelRatings(user *User) (<-chan Rating, error) {
 	}()
 
 	// Wait for the like and dislike goroutines to finish, then close the
-	// rating channel
+	// error and rating channels
 	go func() {
 		wg.Wait()
+		close(errCh)
 		close(ratingCh)
 	}()
 
-	return ratingCh, nil
+	return ratingCh, errCh
 }
 
 // GetRatings retrieves all items a user has rated and returns a map of
@@ -733,12 +741,26 @@ func (r *Recommender) GetRatings(user *User) (map[string]Rating, error) {
 	// As ratings are sent through the rating channel, build out rating
 	// map. Return map when channel closes.
 	ratings := make(map[string]Rating)
-	ratingCh, err := r.channelRatings(user)
+	ratingCh, errCh := r.channelRatings(user)
+	for rating := range ratingCh {
+		ratings[rating.Item.Id] = rating
+	}
+	err := <-errCh
 	if err != nil {
 		return nil, err
 	}
-	for rating := range ratingCh {
-		ratings[rating.Item.Id] = rating
+
+	// Stamp each rating with the time of its last change
+	var times map[string]time.Time
+	if err := r.view(func(tx namespace) error {
+		times, err = r.ratingTimes(tx, user.Id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	for itemId, rating := range ratings {
+		rating.Time = times[itemId]
+		ratings[itemId] = rating
 	}
 
 	return ratings, nil
@@ -787,7 +809,8 @@ func (r *Recommender) GetRatingNeighbors(user *User) (map[string]User, error) {
 }
 
 // UpdateSimilarity calculates the similarity index for each user with which the
-// given user has overlapping rated items.
+// given user has overlapping rated items. Ratings keep these records current as
+// they are recorded, so this is only needed to rebuild them.
 func (r *Recommender) UpdateSimilarity(user *User) error {
 	// Get user's rated items
 	// TODO If user's ratings are already populated, skip this?
@@ -804,19 +827,22 @@ func (r *Recommender) UpdateSimilarity(user *User) error {
 		return err
 	}
 
-	// Compute similarity index for each of user's neighbors
+	// Compute similarity record for each of user's neighbors
 	// Run each neighbor concurrently, but wait for completion of all
+	type neighborRecord struct {
+		neighbor User
+		record   similarityRecord
+	}
 	var wg sync.WaitGroup
-	similarityCh := make(chan *Similarity)
+	similarityCh := make(chan *neighborRecord)
 	for _, neighbor := range neighbors {
 		wg.Add(1)
 		// Create new instance of neighbor for goroutine
 		neighbor := neighbor
 		go func() {
-			index := r.similarityIndex(user, &neighbor)
-			similarityCh <- &Similarity{
-				User:  neighbor,
-				Index: index,
+			similarityCh <- &neighborRecord{
+				neighbor: neighbor,
+				record:   r.similarityIndex(user, &neighbor),
 			}
 			wg.Done()
 		}()
@@ -828,18 +854,22 @@ func (r *Recommender) UpdateSimilarity(user *User) error {
 		close(similarityCh)
 	}()
 
-	// Map neighbor's user ID to similarity index
+	// Map neighbor's user ID to similarity record. Keep receiving after an
+	// error, so that no goroutine is left blocked.
 	for similarity := range similarityCh {
+		if err != nil {
+			continue
+		}
 		// Update database
-		r.updateSimilarity(user, &similarity.User, similarity.Index)
+		err = r.updateSimilarity(user, &similarity.neighbor, similarity.record)
 	}
 
-	return nil
+	return err
 }
 
-// similarityIndex calculates the current similarity index based on the ratings
-// in each user's Ratings
-func (r *Recommender) similarityIndex(user1, user2 *User) SimilarityIndex {
+// similarityIndex tallies the agreement between the ratings in each user's
+// Ratings
+func (r *Recommender) similarityIndex(user1, user2 *User) similarityRecord {
 	var agree, disagree int
 
 	for id, rating1 := range user1.Ratings {
@@ -852,53 +882,14 @@ func (r *Recommender) similarityIndex(user1, user2 *User) SimilarityIndex {
 		}
 	}
 
-	index := float32((agree - disagree)) / float32((agree + disagree))
-
-	return SimilarityIndex(index)
+	return similarityRecord{Agree: agree, Disagree: disagree}
 }
 
-// updateSimilarity updates the similarity index for the given users
-func (r *Recommender) updateSimilarity(user1 *User, user2 *User, index SimilarityIndex) error {
-	if err := r.db.Update(func(tx *bolt.Tx) error {
-		userSimilarityBucket := tx.Bucket([]byte(userSimilarityBucketName))
-
-		// Get user1's existing similarities
-		similarityMap := make(map[string]SimilarityIndex)
-		if data := userSimilarityBucket.Get([]byte(user1.Id)); data != nil {
-			if err := json.Unmarshal(data, &similarityMap); err != nil {
-				return err
-			}
-		}
-		// Set new index
-		similarityMap[user2.Id] = index
-		data, err := json.Marshal(similarityMap)
-		if err != nil {
-			return err
-		}
-		// Write updated map to bucket
-		if err := userSimilarityBucket.Put([]byte(user1.Id), data); err != nil {
-			return err
-		}
-
-		// Get user2's existing similarities
-		similarityMap = make(map[string]SimilarityIndex)
-		if data := userSimilarityBucket.Get([]byte(user2.Id)); data != nil {
-			if err := json.Unmarshal(data, &similarityMap); err != nil {
-				return err
-			}
-		}
-		// Set new index
-		similarityMap[user1.Id] = index
-		data, err = json.Marshal(similarityMap)
-		if err != nil {
-			return err
-		}
-		// Write updated map to bucket
-		if err := userSimilarityBucket.Put([]byte(user2.Id), data); err != nil {
-			return err
-		}
-
-		return nil
+// updateSimilarity updates the similarity record for the given users
+func (r *Recommender) updateSimilarity(user1 *User, user2 *User, record similarityRecord) error {
+	if err := r.update(func(tx namespace) error {
+		// Write the record in both directions
+		return r.putRecord(tx, userSimilarityBucketName, user1.Id, user2.Id, record)
 	}); err != nil {
 		return err
 	}
@@ -906,165 +897,569 @@ func (r *Recommender) updateSimilarity(user1 *User, user2 *User, index Similarit
 	return nil
 }
 
-// channelSimilarity returns a channel of the given user's similarities
-func (r *Recommender) channelSimilarity(user *User) (<-chan Similarity, error) {
+// channelSimilarity sends the given user's similarities through the returned
+// similarity channel, which is closed once all are sent. An error is sent
+// through the error channel, which is closed before the similarity channel.
+func (r *Recommender) channelSimilarity(user *User) (<-chan Similarity, <-chan error) {
 	similarityCh := make(chan Similarity)
-	similarityIndexMap := make(map[string]SimilarityIndex)
-
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		userSimilarityBucket := tx.Bucket([]byte(userSimilarityBucketName))
-		if data := userSimilarityBucket.Get([]byte(user.Id)); data != nil {
-			if err := json.Unmarshal(data, &similarityIndexMap); err != nil {
-				return err
-			}
+	errCh := make(chan error, 1)
+	var similarities map[string]pairSimilarity
+
+	if err := r.view(func(tx namespace) error {
+		var err error
+		// With decay or implicit feedback, weigh every shared preference
+		if r.weighted(tx, user.Id) {
+			similarities, err = r.weightedSimilarities(tx, user.Id, r.clock())
+			return err
+		}
+		records, err := r.getRecords(tx, userSimilarityBucketName, user.Id)
+		if err != nil {
+			return err
+		}
+		similarities = make(map[string]pairSimilarity)
+		for id, record := range records {
+			similarities[id] = pairSimilarity{record.index(), record.overlap()}
 		}
 		return nil
 	}); err != nil {
-		return nil, err
+		errCh <- err
+		close(errCh)
+		close(similarityCh)
+		return similarityCh, errCh
 	}
 
 	go func() {
-		for id, index := range similarityIndexMap {
+		defer close(similarityCh)
+		defer close(errCh)
+		for id, similarity := range similarities {
 			u, err := r.getUser(id)
+			if err == ErrUserNotFound {
+				r.logger.Warn("missing user", "user", id, "similar", user.Id)
+				continue
+			}
 			if err != nil {
-				close(similarityCh)
+				errCh <- err
 				return
 			}
 			similarityCh <- Similarity{
-				User:  *u,
-				Index: index,
+				User:    *u,
+				Index:   similarity.index,
+				Overlap: similarity.overlap,
 			}
 		}
-		close(similarityCh)
 	}()
 
-	return similarityCh, nil
+	return similarityCh, errCh
 }
 
 // GetSimilarity returns a map the given user's similarities, keyed by their
 // similar user's ID
 func (r *Recommender) GetSimilarity(user *User) (map[string]Similarity, error) {
 	similarityMap := make(map[string]Similarity)
-	similarityCh, err := r.channelSimilarity(user)
-	if err != nil {
-		return nil, err
-	}
+	similarityCh, errCh := r.channelSimilarity(user)
 	for similarity := range similarityCh {
 		similarityMap[similarity.User.Id] = similarity
 	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
 	return similarityMap, nil
 }
 
+// GetSimilarUsers returns up to n of the given user's neighbors, ranked from
+// most to least similar. Neighbors sharing fewer than opts.MinOverlap co-rated
+// items are excluded, and indices are shrunk by significance weighting when
+// opts.SignificanceThreshold is set. If n is not positive, every remaining
+// neighbor is returned.
+func (r *Recommender) GetSimilarUsers(user *User, n int, opts SimilarUsersOptions) ([]Similarity, error) {
+	similarityCh, errCh := r.channelSimilarity(user)
+
+	var similarities []Similarity
+	for similarity := range similarityCh {
+		if similarity.Overlap < opts.MinOverlap {
+			continue
+		}
+		similarity.Index = significance(similarity.Index, similarity.Overlap, opts.SignificanceThreshold)
+		similarities = append(similarities, similarity)
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	sortSimilarities(similarities)
+	if n > 0 && len(similarities) > n {
+		similarities = similarities[:n]
+	}
+
+	return similarities, nil
+}
+
 // UpdateSuggestions generates a set of Suggestions (items with corresponding
-// suggestion index) for the given user.
+// suggestion index) for the given user. Only neighbors selected by the
+// Recommender's Neighborhood contribute.
 func (r *Recommender) UpdateSuggestions(user *User) error {
-	//log.Printf("UpdateSuggestions(%s)\n", user.Name)
+	start := time.Now()
+
+	// Note whether suggestions are marked stale, to clear the mark once
+	// they are saved
+	var mark []byte
+	if err := r.view(func(tx namespace) error {
+		if data := tx.Bucket([]byte(staleSuggestionsBucketName)).Get([]byte(user.Id)); data != nil {
+			mark = append(mark, data...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Get the user's own scores, explicit and implicit, so items the user
+	// already has a preference for can be skipped
+	now := r.clock()
+	var ratings map[string]Score
+	if err := r.view(func(tx namespace) error {
+		var err error
+		ratings, _, err = r.preferences(tx, user.Id, now)
+		return err
+	}); err != nil {
+		return err
+	}
 
-	// Get similarities for user
+	// Get similarities for user, then select the neighborhood
 	similarityMap, err := r.GetSimilarity(user)
 	if err != nil {
 		return err
 	}
-
-	// For each similarity, get similar user's rated items, but only items
-	// user has not rated.
-	itemCh := make(chan Item)
+	neighbors := r.neighborhood.selectNeighbors(similarityMap)
+
+	// For each neighbor, get the neighbor's scores, but only for items the
+	// user has not rated, along with the weight of each score.
+	type neighborScore struct {
+		itemId string
+		score  Score
+		index  SimilarityIndex
+		weight float32
+	}
+	scoreCh := make(chan neighborScore)
+	errCh := make(chan error, len(neighbors))
 	var wg sync.WaitGroup
-	for _, similarity := range similarityMap {
+	for _, neighbor := range neighbors {
 		wg.Add(1)
-		// Create new instance of similarity for goroutine
-		similarity := similarity
+		// Create new instance of neighbor for goroutine
+		neighbor := neighbor
 		go func() {
-			// Get similar user's ratings
-			ratingsCh, err := r.channelRatings(&(similarity.User))
-			if err != nil {
+			defer wg.Done()
+			var scores map[string]Score
+			var weights map[string]float32
+			if err := r.view(func(tx namespace) error {
+				var err error
+				scores, weights, err = r.preferences(tx, neighbor.User.Id, now)
+				return err
+			}); err != nil {
+				errCh <- err
 				return
 			}
-			// For each rated item, if user has not rated the item,
-			// send it into itemCh
-			for r := range ratingsCh {
-				if _, exists := user.Ratings[r.Item.Id]; !exists {
-					itemCh <- r.Item
+			for itemId, score := range scores {
+				if _, exists := ratings[itemId]; !exists {
+					scoreCh <- neighborScore{itemId, score, neighbor.Index, weights[itemId]}
 				}
 			}
-			wg.Done()
 		}()
 	}
 
 	go func() {
-		defer close(itemCh)
+		defer close(scoreCh)
 		wg.Wait()
 	}()
 
 	// For each item, suggestion index = (zL-zD)/total, where zL is the sum
-	// of the similarity indices of users who like the item, zD is the sum
-	// of the similarity indices of users who dislike the item, and total is
-	// the total number of users composing zL and zD.
-	// TODO Can we optimize this?
+	// of the similarity indices of neighbors who like the item, zD is the
+	// sum of the similarity indices of neighbors who dislike the item, and
+	// total is the number of neighbors composing zL and zD. With decay or
+	// implicit feedback, each neighbor's score counts by its weight instead
+	// of once.
+	tallies := make(map[string]*tally)
+	for s := range scoreCh {
+		t, exists := tallies[s.itemId]
+		if !exists {
+			t = &tally{}
+			tallies[s.itemId] = t
+		}
+		t.add(s.score, s.index, s.weight)
+	}
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	// Replace the user's suggestions, keyed by item ID
+	if err := r.update(func(tx namespace) error {
+		if err := deleteAllNested(tx, suggestionBucketName, user.Id); err != nil {
+			return err
+		}
+		for itemId, t := range tallies {
+			if inSet(tx, hiddenBucketName, user.Id, itemId) {
+				continue
+			}
+			data, err := r.codec.Marshal(t.index())
+			if err != nil {
+				return err
+			}
+			if err := putNested(tx, suggestionBucketName, user.Id, itemId, data); err != nil {
+				return err
+			}
+		}
+
+		// Clear the stale mark, unless the user rated again meanwhile
+		staleSuggestionsBucket := tx.Bucket([]byte(staleSuggestionsBucketName))
+		if current := staleSuggestionsBucket.Get([]byte(user.Id)); current != nil && bytes.Equal(current, mark) {
+			if err := staleSuggestionsBucket.Delete([]byte(user.Id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	r.logger.Debug("suggestions updated", "user", user.Id, "neighbors", len(neighbors), "suggestions", len(tallies), "duration", time.Since(start))
+	return nil
+}
+
+// GetSuggestions retrieves the set of Suggestions for the given user. Items
+// the user has hidden, inactive items and items outside their availability
+// window are never included, and items the user keeps ignoring are demoted
+// according to the Recommender's Suppression. Boost, Bury and Exclude rules
+// are then applied.
+func (r *Recommender) GetSuggestions(user *User) (map[string]Suggestion, error) {
 	suggestionMap := make(map[string]Suggestion)
-	for item := range itemCh {
-		// Get all users who have rated the item, separated into like
-		// and dislike.
-		likeUsers, err := r.GetUsersWhoLike(&item)
+	if err := r.view(func(tx namespace) error {
+		suggestionBucket := nestedBucket(tx, suggestionBucketName, user.Id)
+		if suggestionBucket == nil {
+			return nil
+		}
+		itemBucket := tx.Bucket([]byte(itemBucketName))
+		rules, err := r.getRules(tx)
 		if err != nil {
 			return err
 		}
-		dislikeUsers, err := r.GetUsersWhoDislike(&item)
+		now := r.clock()
+		cur := suggestionBucket.Cursor()
+		for key, val := cur.First(); key != nil; key, val = cur.Next() {
+			if inSet(tx, hiddenBucketName, user.Id, string(key)) {
+				continue
+			}
+			var suggestion Suggestion
+			if err := r.codec.Unmarshal(val, &suggestion.Index); err != nil {
+				return err
+			}
+			record, err := r.impressions(tx, user.Id, string(key))
+			if err != nil {
+				return err
+			}
+			suggestion.Index = r.suppression.demote(suggestion.Index, record)
+			data := itemBucket.Get(key)
+			if data == nil {
+				r.logger.Warn("missing item", "item", string(key), "user", user.Id)
+				continue
+			}
+			if err := r.codec.Unmarshal(data, &suggestion.Item); err != nil {
+				return err
+			}
+			if !suggestion.Item.available(now) {
+				continue
+			}
+			var kept bool
+			if suggestion.Index, kept = rules.apply(suggestion); !kept {
+				continue
+			}
+			suggestionMap[string(key)] = suggestion
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return suggestionMap, nil
+}
+
+// getScores reads the like and dislike ID sets stored under the given key and
+// returns a map of counterpart ID to Score.
+func (r *Recommender) getScores(likesBucketName, dislikesBucketName, id string) (map[string]Score, error) {
+	var scores map[string]Score
+
+	if err := r.view(func(tx namespace) error {
+		var err error
+		scores, err = scoresTx(tx, likesBucketName, dislikesBucketName, id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return scores, nil
+}
+
+// scoresTx reads the like and dislike ID sets stored under the given key
+// within the given transaction.
+func scoresTx(tx namespace, likesBucketName, dislikesBucketName, id string) (map[string]Score, error) {
+	scores := make(map[string]Score)
+	for bucketName, score := range map[string]Score{likesBucketName: like, dislikesBucketName: dislike} {
+		for id := range setMembers(tx, bucketName, id) {
+			scores[id] = score
+		}
+	}
+	return scores, nil
+}
+
+// userScore returns the user's current score for the item, or zero if the
+// user has not rated the item.
+func userScore(tx namespace, userId, itemId string) (Score, error) {
+	if inSet(tx, userLikesBucketName, userId, itemId) {
+		return like, nil
+	}
+	if inSet(tx, userDislikesBucketName, userId, itemId) {
+		return dislike, nil
+	}
+	return 0, nil
+}
+
+// updateSimilarityRecords moves a single rating's contribution in every
+// similarity record the rating is part of, after the user's score for the
+// item changed from previous to current. User pairs are found among the
+// item's other raters and item pairs among the user's other rated items, so
+// the cost grows with those rather than with every neighbor's ratings.
+func (r *Recommender) updateSimilarityRecords(tx namespace, userId, itemId string, previous, current Score) error {
+	if previous == current {
+		return nil
+	}
+
+	raters, err := scoresTx(tx, itemLikesBucketName, itemDislikesBucketName, itemId)
+	if err != nil {
+		return err
+	}
+	delete(raters, userId)
+	if err := r.adjustSimilarityRecords(tx, userSimilarityBucketName, userId, raters, previous, current); err != nil {
+		return err
+	}
+
+	rated, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, userId)
+	if err != nil {
+		return err
+	}
+	delete(rated, itemId)
+	return r.adjustSimilarityRecords(tx, itemSimilarityBucketName, itemId, rated, previous, current)
+}
+
+// adjustSimilarityRecords replaces the contribution of score previous with
+// that of score current in the records pairing id with each of others, where
+// others maps each counterpart to its own score for the shared entry. Both
+// directions of each pair are written, and records left without overlap are
+// removed.
+func (r *Recommender) adjustSimilarityRecords(tx namespace, bucketName, id string, others map[string]Score, previous, current Score) error {
+	for otherId, other := range others {
+		record, err := r.getRecord(tx, bucketName, id, otherId)
 		if err != nil {
 			return err
 		}
-		// Scan each similar user for a like/dislike score. If one
-		// exists, increment index parameters.
-		var zL, zD, total float32
-		for id, similarity := range similarityMap {
-			if _, exists := likeUsers[id]; exists {
-				zL += float32(similarity.Index)
-				total++
-			} else if _, exists := dislikeUsers[id]; exists {
-				zD += float32(similarity.Index)
-				total++
-			}
+		record = record.count(previous, other, -1).count(current, other, 1)
+		if err := r.putRecord(tx, bucketName, id, otherId, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateItemSimilarity calculates the similarity index for each item with
+// which the given item shares at least one rater. Two items agree for a rater
+// when the rater gave both items the same score. Ratings keep these records
+// current as they are recorded, so this is only needed to rebuild them.
+func (r *Recommender) UpdateItemSimilarity(item *Item) error {
+	// Get the item's raters, mapped to the score each gave the item
+	raters, err := r.getScores(itemLikesBucketName, itemDislikesBucketName, item.Id)
+	if err != nil {
+		return err
+	}
+
+	// Tally agreement with every other item each rater has rated
+	records := make(map[string]similarityRecord)
+	for userId, score := range raters {
+		scores, err := r.getScores(userLikesBucketName, userDislikesBucketName, userId)
+		if err != nil {
+			return err
 		}
-		// Build Suggestion, then add it to the map
-		index := (zL - zD) / total
-		suggestionMap[item.Id] = Suggestion{
-			Item:  item,
-			Index: SuggestionIndex(index),
+		for itemId, other := range scores {
+			if itemId == item.Id {
+				continue
+			}
+			record := records[itemId]
+			if other == score {
+				record.Agree++
+			} else {
+				record.Disagree++
+			}
+			records[itemId] = record
 		}
 	}
 
-	// Save the suggestion map, keyed by the user's Id
-	if err := r.db.Update(func(tx *bolt.Tx) error {
-		suggestionBucket := tx.Bucket([]byte(suggestionBucketName))
-		data, err := json.Marshal(suggestionMap)
+	return r.update(func(tx namespace) error {
+		// Remove items that were similar before, but no longer share raters
+		previous, err := r.getRecords(tx, itemSimilarityBucketName, item.Id)
+		if err != nil {
+			return err
+		}
+		for id := range previous {
+			if _, exists := records[id]; !exists {
+				if err := r.putRecord(tx, itemSimilarityBucketName, item.Id, id, similarityRecord{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Write each record in both directions
+		for id, record := range records {
+			if err := r.putRecord(tx, itemSimilarityBucketName, item.Id, id, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSimilarItems returns up to n items most similar to the given item, ranked
+// from most to least similar. Similarity comes from users who rated both
+// items; when both items have attributes, shared attributes count as one
+// additional co-rater, so items nobody has co-rated can still be returned.
+// Those are found through the attribute index, so only items sharing an
+// attribute with the given item are read. If n is not positive, every similar
+// item is returned.
+func (r *Recommender) GetSimilarItems(item *Item, n int) ([]ItemSimilarity, error) {
+	var similarItems []ItemSimilarity
+
+	if err := r.view(func(tx namespace) error {
+		itemBucket := tx.Bucket([]byte(itemBucketName))
+
+		target, err := r.storedItem(tx, item)
 		if err != nil {
 			return err
 		}
-		if err := suggestionBucket.Put([]byte(user.Id), data); err != nil {
+
+		records, err := r.getRecords(tx, itemSimilarityBucketName, item.Id)
+		if err != nil {
 			return err
 		}
+
+		// Rating similarity, blended with attribute similarity
+		seen := make(map[string]bool)
+		for id, record := range records {
+			data := itemBucket.Get([]byte(id))
+			if data == nil {
+				r.logger.Warn("missing item", "item", id, "similar", item.Id)
+				continue
+			}
+			var other Item
+			if err := r.codec.Unmarshal(data, &other); err != nil {
+				return err
+			}
+			seen[id] = true
+			similarItems = append(similarItems, ItemSimilarity{
+				Item:     other,
+				Index:    blendedSimilarity(record, &target, &other),
+				CoRaters: record.overlap(),
+			})
+		}
+
+		// Attribute similarity alone, for items without co-raters that
+		// share an attribute
+		candidates := make(map[string]bool)
+		for name, value := range target.Attributes {
+			for id := range setMembers(tx, itemAttributeBucketName, attributeKey(name, value)) {
+				candidates[id] = true
+			}
+		}
+		for id := range candidates {
+			if id == target.Id || seen[id] {
+				continue
+			}
+			data := itemBucket.Get([]byte(id))
+			if data == nil {
+				r.logger.Warn("missing item", "item", id, "similar", item.Id)
+				continue
+			}
+			var other Item
+			if err := r.codec.Unmarshal(data, &other); err != nil {
+				return err
+			}
+			if index := attributeSimilarity(&target, &other); index > 0 {
+				similarItems = append(similarItems, ItemSimilarity{
+					Item:  other,
+					Index: SimilarityIndex(index),
+				})
+			}
+		}
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Rank by index, then by the number of co-raters behind the index
+	sort.Slice(similarItems, func(i, j int) bool {
+		a, b := similarItems[i], similarItems[j]
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		if a.CoRaters != b.CoRaters {
+			return a.CoRaters > b.CoRaters
+		}
+		return a.Item.Id < b.Item.Id
+	})
+	if n > 0 && len(similarItems) > n {
+		similarItems = similarItems[:n]
+	}
+
+	return similarItems, nil
 }
 
-// GetSuggestions retrieves the set of Suggestions for the given user.
-func (r *Recommender) GetSuggestions(user *User) (map[string]Suggestion, error) {
-	suggestionMap := make(map[string]Suggestion)
-	if err := r.db.View(func(tx *bolt.Tx) error {
-		suggestionBucket := tx.Bucket([]byte(suggestionBucketName))
-		if data := suggestionBucket.Get([]byte(user.Id)); data != nil {
-			if err := json.Unmarshal(data, &suggestionMap); err != nil {
+// Predict estimates the given user's score for the given item from the
+// neighbors selected by the Recommender's Neighborhood. Unlike
+// UpdateSuggestions, it considers items the user has already rated, and it
+// does not change the user's stored suggestions.
+func (r *Recommender) Predict(user *User, item *Item) (*Prediction, error) {
+	similarityMap, err := r.GetSimilarity(user)
+	if err != nil {
+		return nil, err
+	}
+	now := r.clock()
+
+	// Tally the scores of neighbors who rated the item
+	var t tally
+	var stored Item
+	if err := r.view(func(tx namespace) error {
+		var err error
+		if stored, err = r.storedItem(tx, item); err != nil {
+			return err
+		}
+		raters, err := r.raters(tx, item.Id)
+		if err != nil {
+			return err
+		}
+		for _, neighbor := range r.neighborhood.selectNeighbors(similarityMap) {
+			if !raters[neighbor.User.Id] {
+				continue
+			}
+			scores, weights, err := r.preferences(tx, neighbor.User.Id, now)
+			if err != nil {
 				return err
 			}
+			t.add(scores[item.Id], neighbor.Index, weights[item.Id])
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	return suggestionMap, nil
+	return &Prediction{
+		Item:       stored,
+		Index:      t.index(),
+		Confidence: t.confidence(),
+		Neighbors:  t.neighbors,
+	}, nil
 }
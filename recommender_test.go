@@ -1,10 +1,18 @@
 package recommender_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/nikovacevic/recommender"
 )
 
@@ -582,3 +590,2196 @@ func TestSuggestions(t *testing.T) {
 		}
 	}
 }
+
+func TestSimilarItems(t *testing.T) {
+	r, err := recommender.NewRecommender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	johnny := recommender.NewUser("Johnny Bernard")
+
+	phoenix := recommender.NewItem("Phoenix")
+	tucson := recommender.NewItem("Tucson")
+	seattle := recommender.NewItem("Seattle")
+	portland := recommender.NewItem("Portland")
+	salem := recommender.NewItem("Salem")
+
+	// GetSimilarItems should return nothing at this point
+	similarItems, err := r.GetSimilarItems(phoenix, 10)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarItems) != 0 {
+		t.Errorf("There should be 0 similar items. There are %d.", len(similarItems))
+	}
+
+	r.Like(niko, phoenix)
+	r.Like(niko, tucson)
+	r.Dislike(niko, seattle)
+	r.Like(aubreigh, phoenix)
+	r.Like(aubreigh, tucson)
+	r.Like(aubreigh, seattle)
+	r.Like(johnny, phoenix)
+	r.Dislike(johnny, tucson)
+
+	// Tucson (1/3 from three co-raters) ranks ahead of Seattle (0 from two)
+	similarItems, err = r.GetSimilarItems(phoenix, 10)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarItems) != 2 {
+		t.Fatalf("There should be 2 similar items. There are %d: %v", len(similarItems), similarItems)
+	}
+	if similarItems[0].Item.Id != tucson.Id || similarItems[1].Item.Id != seattle.Id {
+		t.Errorf("Similar items should be ranked Tucson, Seattle. Actually %v", similarItems)
+	}
+	if float32(similarItems[0].Index) != float32(1.0/3.0) || similarItems[0].CoRaters != 3 {
+		t.Errorf("Similarity(Phoenix, Tucson) should be %f from 3 co-raters. Actually %v", float32(1.0/3.0), similarItems[0])
+	}
+	if similarItems[1].Index != 0 || similarItems[1].CoRaters != 2 {
+		t.Errorf("Similarity(Phoenix, Seattle) should be 0 from 2 co-raters. Actually %v", similarItems[1])
+	}
+
+	// Limit the number of results
+	similarItems, err = r.GetSimilarItems(phoenix, 1)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarItems) != 1 {
+		t.Errorf("There should be 1 similar item. There are %d.", len(similarItems))
+	}
+
+	// Items without co-raters are similar through their attributes
+	portland.Attributes = map[string]string{"state": "Oregon"}
+	salem.Attributes = map[string]string{"state": "Oregon"}
+	if err := r.SaveItem(portland); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if err := r.SaveItem(salem); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	similarItems, err = r.GetSimilarItems(portland, 10)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	found := false
+	for _, similarItem := range similarItems {
+		if similarItem.Item.Id == salem.Id {
+			found = true
+			if similarItem.Index != 1 || similarItem.CoRaters != 0 {
+				t.Errorf("Similarity(Portland, Salem) should be 1 from 0 co-raters. Actually %v", similarItem)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Salem should be similar to Portland: %v", similarItems)
+	}
+
+	// Once Salem's attributes change, it no longer shares any
+	salem.Attributes = map[string]string{"state": "Washington"}
+	if err := r.SaveItem(salem); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	similarItems, err = r.GetSimilarItems(portland, 10)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	for _, similarItem := range similarItems {
+		if similarItem.Item.Id == salem.Id {
+			t.Errorf("Salem should no longer be similar to Portland: %v", similarItems)
+		}
+	}
+}
+
+func TestAttributeIndexMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cities, err := r.Tenant("cities")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	portland := recommender.NewItem("Portland")
+	portland.Attributes = map[string]string{"state": "Oregon"}
+	salem := recommender.NewItem("Salem")
+	salem.Attributes = map[string]string{"state": "Oregon"}
+	for _, item := range []*recommender.Item{portland, salem} {
+		r.SaveItem(item)
+		cities.SaveItem(item)
+	}
+	r.Close()
+
+	// Remove the attribute index and stamp the file with the version before it
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("itemAttribute")); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte("tenants")).Bucket([]byte("cities")).DeleteBucket([]byte("itemAttribute")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("meta")).Put([]byte("schemaVersion"), []byte{0, 0, 0, 0, 0, 0, 0, 4})
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	// A read-only open refuses to upgrade the file
+	if _, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithReadOnly()); !errors.As(err, new(*recommender.SchemaVersionError)) {
+		t.Errorf("Opening an older file read-only should be a *SchemaVersionError. Error is %v", err)
+	}
+
+	// Opening the database rebuilds the index in every tenant
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	cities, err = r.Tenant("cities")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	for name, tenant := range map[string]*recommender.Recommender{"default": r, "cities": cities} {
+		similarItems, err := tenant.GetSimilarItems(portland, 0)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if len(similarItems) != 1 || similarItems[0].Item.Id != salem.Id {
+			t.Errorf("Salem should be similar to Portland in the %s tenant. Similar items are %v", name, similarItems)
+		}
+	}
+}
+
+func TestSimilarUsers(t *testing.T) {
+	r, err := recommender.NewRecommender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	johnny := recommender.NewUser("Johnny Bernard")
+	nick := recommender.NewUser("Nick Evers")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	pittsburgh := recommender.NewItem("Pittsburgh")
+	seattle := recommender.NewItem("Seattle")
+
+	r.Like(niko, boulder)
+	r.Like(niko, denver)
+	r.Like(niko, pittsburgh)
+	r.Like(niko, seattle)
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(aubreigh, pittsburgh)
+	r.Like(aubreigh, seattle)
+
+	r.Like(johnny, boulder)
+
+	r.Dislike(nick, boulder)
+	r.Dislike(nick, denver)
+	r.Like(nick, pittsburgh)
+
+	// Ties in index are broken by overlap
+	similarities, err := r.GetSimilarUsers(niko, 0, recommender.SimilarUsersOptions{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarities) != 3 {
+		t.Fatalf("There should be 3 similar users. There are %d: %v", len(similarities), similarities)
+	}
+	if similarities[0].User.Id != aubreigh.Id || similarities[1].User.Id != johnny.Id || similarities[2].User.Id != nick.Id {
+		t.Errorf("Similar users should be ranked Aubreigh, Johnny, Nick. Actually %v", similarities)
+	}
+	if similarities[0].Overlap != 4 || similarities[1].Overlap != 1 || similarities[2].Overlap != 3 {
+		t.Errorf("Overlaps should be 4, 1, 3. Actually %v", similarities)
+	}
+
+	// Neighbors sharing a single item are excluded
+	similarities, err = r.GetSimilarUsers(niko, 0, recommender.SimilarUsersOptions{MinOverlap: 2})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarities) != 2 {
+		t.Errorf("There should be 2 similar users. There are %d: %v", len(similarities), similarities)
+	}
+
+	// Significance weighting shrinks indices with little overlap
+	similarities, err = r.GetSimilarUsers(niko, 2, recommender.SimilarUsersOptions{SignificanceThreshold: 4})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarities) != 2 {
+		t.Fatalf("There should be 2 similar users. There are %d: %v", len(similarities), similarities)
+	}
+	if similarities[0].Index != 1 {
+		t.Errorf("Similarity(Niko, Aubreigh) should be 1. Actually %v", similarities[0])
+	}
+	if similarities[1].Index != 0.25 {
+		t.Errorf("Similarity(Niko, Johnny) should be 0.25. Actually %v", similarities[1])
+	}
+}
+
+func TestNeighborhood(t *testing.T) {
+	r, err := recommender.NewRecommender()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	johnny := recommender.NewUser("Johnny Bernard")
+	nick := recommender.NewUser("Nick Evers")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	seattle := recommender.NewItem("Seattle")
+	phoenix := recommender.NewItem("Phoenix")
+	houston := recommender.NewItem("Houston")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(aubreigh, seattle)
+	r.Like(johnny, boulder)
+	r.Dislike(johnny, denver)
+	r.Like(johnny, phoenix)
+	r.Dislike(nick, boulder)
+	r.Dislike(nick, denver)
+	r.Dislike(nick, houston)
+	r.Like(niko, boulder)
+	r.Like(niko, denver)
+	r.Close()
+
+	// suggest reopens the recommender with the given neighborhood and
+	// returns Niko's suggestions
+	suggest := func(neighborhood recommender.Neighborhood) map[string]recommender.Suggestion {
+		r, err := recommender.NewRecommender(recommender.WithNeighborhood(neighborhood))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+		if err := r.UpdateSuggestions(niko); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		suggestions, err := r.GetSuggestions(niko)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		return suggestions
+	}
+
+	// Every neighbor contributes by default; Nick's dislike of Houston counts
+	// in its favor
+	suggestions := suggest(recommender.Neighborhood{})
+	if len(suggestions) != 3 {
+		t.Errorf("There should be 3 suggestions. There are %d: %v", len(suggestions), suggestions)
+	}
+	if suggestions[houston.Id].Index != 1 {
+		t.Errorf("Suggestion(Niko, Houston) should be 1. Actually %v", suggestions[houston.Id])
+	}
+
+	// Negatively correlated neighbors can be excluded
+	suggestions = suggest(recommender.Neighborhood{ExcludeNegative: true})
+	if _, exists := suggestions[houston.Id]; exists || len(suggestions) != 2 {
+		t.Errorf("There should be 2 suggestions, excluding Houston. There are %d: %v", len(suggestions), suggestions)
+	}
+
+	// Neighbors with near-zero similarity can be excluded
+	suggestions = suggest(recommender.Neighborhood{MinSimilarity: 0.5})
+	if _, exists := suggestions[phoenix.Id]; exists || len(suggestions) != 2 {
+		t.Errorf("There should be 2 suggestions, excluding Phoenix. There are %d: %v", len(suggestions), suggestions)
+	}
+
+	// The neighborhood can be capped
+	suggestions = suggest(recommender.Neighborhood{K: 1, ExcludeNegative: true})
+	if _, exists := suggestions[seattle.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("There should be 1 suggestion, Seattle. There are %d: %v", len(suggestions), suggestions)
+	}
+
+	// Neighbors with too little overlap can be excluded
+	suggestions = suggest(recommender.Neighborhood{MinOverlap: 3})
+	if len(suggestions) != 0 {
+		t.Errorf("There should be 0 suggestions. There are %d: %v", len(suggestions), suggestions)
+	}
+}
+
+func TestPredict(t *testing.T) {
+	r, err := recommender.NewRecommender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	johnny := recommender.NewUser("Johnny Bernard")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	seattle := recommender.NewItem("Seattle")
+
+	// Without neighbors, there is nothing to predict from
+	prediction, err := r.Predict(niko, seattle)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if prediction.Index != 0 || prediction.Confidence != 0 || prediction.Neighbors != 0 {
+		t.Errorf("Prediction(Niko, Seattle) should be empty. Actually %v", prediction)
+	}
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(aubreigh, seattle)
+	r.Like(johnny, boulder)
+	r.Dislike(johnny, denver)
+	r.Dislike(johnny, seattle)
+	r.Like(niko, boulder)
+	r.Like(niko, denver)
+
+	// Aubreigh (1) likes Seattle and Johnny (0) dislikes it
+	prediction, err = r.Predict(niko, seattle)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if prediction.Index != 0.5 || prediction.Neighbors != 2 {
+		t.Errorf("Prediction(Niko, Seattle) should be 0.5 from 2 neighbors. Actually %v", prediction)
+	}
+	if prediction.Confidence != 0.5 {
+		t.Errorf("Prediction(Niko, Seattle) confidence should be 0.5. Actually %v", prediction.Confidence)
+	}
+	if prediction.Item.Name != seattle.Name {
+		t.Errorf("Prediction(Niko, Seattle) should be for Seattle. Actually %v", prediction.Item)
+	}
+
+	// Items the user has rated can be predicted too
+	prediction, err = r.Predict(niko, denver)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if prediction.Neighbors != 2 {
+		t.Errorf("Prediction(Niko, Denver) should come from 2 neighbors. Actually %v", prediction)
+	}
+
+}
+
+func TestIncrementalSimilarity(t *testing.T) {
+	r, err := recommender.NewRecommender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	johnny := recommender.NewUser("Johnny Bernard")
+	users := []*recommender.User{niko, aubreigh, johnny}
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	phoenix := recommender.NewItem("Phoenix")
+	seattle := recommender.NewItem("Seattle")
+	items := []*recommender.Item{boulder, denver, phoenix, seattle}
+
+	r.Like(niko, boulder)
+	r.Dislike(niko, phoenix)
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, phoenix)
+	r.Like(aubreigh, seattle)
+	r.Dislike(johnny, boulder)
+	r.Like(johnny, denver)
+	r.Like(johnny, seattle)
+	r.Like(niko, denver)
+	r.Like(niko, phoenix)
+	r.Dislike(niko, seattle)
+
+	// Records kept up to date by each rating should match records
+	// recomputed from scratch
+	for _, user := range users {
+		incremental, err := r.GetSimilarity(user)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if err := r.UpdateSimilarity(user); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		recomputed, err := r.GetSimilarity(user)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if len(incremental) != len(recomputed) {
+			t.Errorf("%s should have %d similarities. There are %d: %v", user, len(recomputed), len(incremental), incremental)
+		}
+		for id, similarity := range recomputed {
+			if incremental[id].Index != similarity.Index || incremental[id].Overlap != similarity.Overlap {
+				t.Errorf("Similarity(%s, %s) should be %v. Actually %v", user, similarity.User, similarity, incremental[id])
+			}
+		}
+	}
+	for _, item := range items {
+		incremental, err := r.GetSimilarItems(item, 0)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if err := r.UpdateItemSimilarity(item); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		recomputed, err := r.GetSimilarItems(item, 0)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if fmt.Sprint(incremental) != fmt.Sprint(recomputed) {
+			t.Errorf("Similar items for %s should be %v. Actually %v", item, recomputed, incremental)
+		}
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	phoenix := recommender.NewItem("Phoenix")
+
+	// Changing a rating leaves both directions consistent
+	r.Like(niko, boulder)
+	r.Dislike(niko, phoenix)
+	r.Like(niko, phoenix)
+	r.Dislike(niko, boulder)
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, phoenix)
+
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+	r.Close()
+
+	// Write a phantom like of Denver by Aubreigh, on the item side only
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		likes, err := tx.Bucket([]byte("itemLikes")).CreateBucketIfNotExists([]byte(denver.Id))
+		if err != nil {
+			return err
+		}
+		return likes.Put([]byte(aubreigh.Id), []byte{})
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	report, err = r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	kinds := make(map[recommender.ProblemKind]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	if kinds[recommender.MissingCounterpart] != 1 || kinds[recommender.DanglingReference] != 1 || len(report.Problems) != 2 {
+		t.Errorf("There should be a missing counterpart and a dangling reference. There are %d problems: %v", len(report.Problems), report.Problems)
+	}
+
+	// Repair drops the phantom like, after which Check finds nothing
+	report, err = r.Repair()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(report.Problems) != 2 {
+		t.Errorf("There should be 2 problems repaired. There are %d: %v", len(report.Problems), report.Problems)
+	}
+	report, err = r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+	users, err := r.GetUsersWhoLike(denver)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("There should be 0 users who like Denver. There are %d: %v", len(users), users)
+	}
+}
+
+func TestStaleSuggestionsRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(niko, boulder)
+	r.Close()
+
+	// Simulate a crash after Niko's rating was saved, but before Niko's
+	// suggestions were recomputed
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		suggestions := tx.Bucket([]byte("suggestionBucket"))
+		if suggestions.Bucket([]byte(niko.Id)) != nil {
+			if err := suggestions.DeleteBucket([]byte(niko.Id)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte("staleSuggestions")).Put([]byte(niko.Id), []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	// Opened read-only, the database is left as it is, so Check sees the
+	// stale suggestions and writes fail
+	r, err = recommender.NewRecommender(recommender.WithPath(path), recommender.WithReadOnly())
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != recommender.StaleSuggestion {
+		t.Errorf("There should be 1 problem, the stale suggestions. There are %d: %v", len(report.Problems), report.Problems)
+	}
+	if err := r.Like(niko, denver); err == nil {
+		t.Errorf("Rating a read-only database should fail")
+	}
+	r.Close()
+
+	// Opening the database recomputes the stale suggestions
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[denver.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("There should be 1 suggestion, Denver. There are %d: %v", len(suggestions), suggestions)
+	}
+	report, err = r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+}
+
+func TestNestedBucketMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithCodec(recommender.JSONCodec))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+
+	r.Like(niko, boulder)
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Close()
+
+	// Rewrite the same ratings in the layout of earlier versions, which
+	// stored one JSON value per user or item and recorded no schema version
+	legacy := map[string]map[string]string{
+		"userLikes": {
+			niko.Id:     fmt.Sprintf(`{%q:true}`, boulder.Id),
+			aubreigh.Id: fmt.Sprintf(`{%q:true,%q:true}`, boulder.Id, denver.Id),
+		},
+		"itemLikes": {
+			boulder.Id: fmt.Sprintf(`{%q:true,%q:true}`, niko.Id, aubreigh.Id),
+			denver.Id:  fmt.Sprintf(`{%q:true}`, aubreigh.Id),
+		},
+		"userSimilarity": {
+			niko.Id:     fmt.Sprintf(`{%q:1}`, aubreigh.Id),
+			aubreigh.Id: fmt.Sprintf(`{%q:1}`, niko.Id),
+		},
+		"itemSimilarity": {
+			boulder.Id: fmt.Sprintf(`{%q:1}`, denver.Id),
+			denver.Id:  fmt.Sprintf(`{%q:1}`, boulder.Id),
+		},
+		"suggestionBucket": {
+			niko.Id: fmt.Sprintf(`{%q:{"item":{"id":%q},"index":1}}`, denver.Id, denver.Id),
+		},
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("meta")); err != nil {
+			return err
+		}
+		for bucketName, values := range legacy {
+			if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+				return err
+			}
+			bucket, err := tx.CreateBucket([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+			for key, value := range values {
+				if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	// Opening the database converts the legacy values
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	items, err := r.GetLikedItems(aubreigh)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(items) != 2 {
+		t.Errorf("There should be 2 items Aubreigh likes. There are %d: %v", len(items), items)
+	}
+	users, err := r.GetUsersWhoLike(boulder)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("There should be 2 users who like Boulder. There are %d: %v", len(users), users)
+	}
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[denver.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("There should be 1 suggestion, Denver. There are %d: %v", len(suggestions), suggestions)
+	}
+	if items, _ := r.GetItemsByName(boulder.Name); len(items) != 1 {
+		t.Errorf("There should be 1 item named %s. There are %v", boulder.Name, items)
+	}
+
+	// Similarity records, stored as bare indices, are rebuilt from the ratings
+	similarityMap, err := r.GetSimilarity(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if similarity := similarityMap[aubreigh.Id]; similarity.Index != 1 || similarity.Overlap != 1 {
+		t.Errorf("Niko and Aubreigh should agree on 1 item. Similarity is %v", similarityMap)
+	}
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+
+	// Later ratings update the rebuilt records
+	r.Dislike(niko, denver)
+	similarityMap, _ = r.GetSimilarity(niko)
+	if similarity := similarityMap[aubreigh.Id]; similarity.Index != 0 || similarity.Overlap != 2 {
+		t.Errorf("Niko and Aubreigh should agree on 1 item and disagree on 1. Similarity is %v", similarityMap)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Close()
+
+	// Reopening a current file succeeds
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	} else {
+		r.Close()
+	}
+
+	// Pretend a newer version wrote the file
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("meta")).Put([]byte("schemaVersion"), []byte{0, 0, 0, 0, 0, 0, 1, 0})
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	r, err = recommender.NewRecommender(recommender.WithPath(path))
+	if err == nil {
+		r.Close()
+		t.Fatalf("Opening a newer file should fail")
+	}
+	versionErr, ok := err.(*recommender.SchemaVersionError)
+	if !ok {
+		t.Fatalf("Error should be a *SchemaVersionError. It is %T: %s", err, err)
+	}
+	if versionErr.Version != 256 {
+		t.Errorf("Version should be 256. It is %d", versionErr.Version)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithCodec(recommender.JSONCodec))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	chris := &recommender.User{Id: "chris", Name: "Chris Cole"}
+
+	boulder := recommender.NewItem("Boulder")
+	boulder.Attributes = map[string]string{"state": "Colorado"}
+	denver := recommender.NewItem("Denver")
+	phoenix := recommender.NewItem("Phoenix")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Dislike(aubreigh, phoenix)
+	r.Dislike(chris, boulder)
+	r.Like(niko, boulder)
+	r.Close()
+
+	// Each reopening re-encodes the file with the given codec, or keeps the
+	// recorded codec when none is given
+	for _, codec := range []recommender.Codec{recommender.BinaryCodec, nil, recommender.JSONCodec} {
+		opts := []recommender.Option{recommender.WithPath(path)}
+		if codec != nil {
+			opts = append(opts, recommender.WithCodec(codec))
+		}
+		r, err = recommender.NewRecommender(opts...)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+
+		users, err := r.GetUsersWhoRated(boulder)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if len(users) != 3 || users["chris"].Name != "Chris Cole" {
+			t.Errorf("There should be 3 users who rated Boulder, including Chris. There are %d: %v", len(users), users)
+		}
+		items, err := r.GetLikedItems(niko)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if items[boulder.Id].Attributes["state"] != "Colorado" {
+			t.Errorf("Boulder should be in Colorado. It is %v", items[boulder.Id])
+		}
+		suggestions, err := r.GetSuggestions(niko)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if suggestion, exists := suggestions[denver.Id]; !exists || suggestion.Index <= 0 {
+			t.Errorf("Denver should be suggested to Niko. Suggestions are %v", suggestions)
+		}
+		report, err := r.Check()
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if !report.OK() {
+			t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+		}
+		r.Close()
+	}
+}
+
+func TestRatingHistory(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	tick := func() {
+		now = now.Add(time.Hour)
+	}
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithClock(clock))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { r.Close() }()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+
+	// 13:00 through 17:00; the repeated like changes nothing and is not logged
+	tick()
+	r.Like(niko, boulder)
+	r.Like(niko, boulder)
+	tick()
+	r.Like(aubreigh, boulder)
+	tick()
+	r.Dislike(niko, boulder)
+	tick()
+	r.Like(niko, denver)
+	tick()
+	r.Unrate(niko, boulder)
+
+	history, err := r.GetUserHistory(niko, time.Time{}, now.Add(time.Hour))
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("There should be 4 events in Niko's history. There are %d: %v", len(history), history)
+	}
+	for i, score := range []recommender.Score{1, -1, 1, 0} {
+		if history[i].Score != score {
+			t.Errorf("Event %d should have score %d. It is %v", i, score, history[i])
+		}
+	}
+
+	// Only Boulder's dislike falls between 14:00 and 16:00
+	from := time.Date(2017, time.March, 1, 14, 0, 0, 0, time.UTC)
+	history, err = r.GetItemHistory(boulder, from, from.Add(2*time.Hour))
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(history) != 2 || history[0].UserId != aubreigh.Id || history[1].Score != -1 {
+		t.Errorf("There should be 2 events for Boulder: Aubreigh's like and Niko's dislike. There are %d: %v", len(history), history)
+	}
+
+	// Niko's only remaining rating is Denver, liked at 16:00
+	ratings, err := r.GetRatings(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(ratings) != 1 {
+		t.Errorf("Niko should have 1 rating. There are %d: %v", len(ratings), ratings)
+	}
+	if rating := ratings[denver.Id]; !rating.Time.Equal(from.Add(2 * time.Hour)) {
+		t.Errorf("Denver should have been rated at %s. It was %s", from.Add(2*time.Hour), rating.Time)
+	}
+	users, err := r.GetUsersWhoRated(boulder)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(users) != 1 {
+		t.Errorf("There should be 1 user who rated Boulder. There are %d: %v", len(users), users)
+	}
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+	r.Close()
+
+	// Empty the like and dislike sets, which replaying the log restores
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{"userLikes", "itemLikes", "userDislikes", "itemDislikes"} {
+			if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(bucketName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	db.Close()
+
+	r, err = recommender.NewRecommender(recommender.WithPath(path), recommender.WithClock(clock))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := r.ReplayRatingLog(); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	ratings, err = r.GetRatings(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(ratings) != 1 || ratings[denver.Id].Score != 1 {
+		t.Errorf("Niko should like only Denver after the replay. Ratings are %v", ratings)
+	}
+	users, err = r.GetUsersWhoRated(boulder)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := users[aubreigh.Id]; !exists || len(users) != 1 {
+		t.Errorf("Only Aubreigh should have rated Boulder after the replay. Users are %v", users)
+	}
+	report, err = r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems after the replay. There are %d: %v", len(report.Problems), report.Problems)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		decay recommender.Decay
+		check func(index recommender.SuggestionIndex) bool
+		want  string
+	}{
+		{"none", recommender.Decay{}, func(index recommender.SuggestionIndex) bool { return index == 0 }, "0"},
+		{"rating age", recommender.Decay{HalfLife: 30 * 24 * time.Hour, By: recommender.RatingAge}, func(index recommender.SuggestionIndex) bool { return index < -0.9 }, "below -0.9"},
+		{"item age", recommender.Decay{HalfLife: 30 * 24 * time.Hour, By: recommender.ItemAge}, func(index recommender.SuggestionIndex) bool { return index > -0.01 && index < 0.01 }, "0"},
+	} {
+		now := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+		clock := func() time.Time {
+			return now
+		}
+		path := filepath.Join(t.TempDir(), "recommender.db")
+		r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithClock(clock), recommender.WithDecay(test.decay))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		niko := recommender.NewUser("Niko Kovacevic")
+		aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+		chris := recommender.NewUser("Chris Cole")
+
+		boulder := recommender.NewItem("Boulder")
+		denver := recommender.NewItem("Denver")
+
+		// Aubreigh's likes are two years older than Chris's ratings
+		r.Like(aubreigh, boulder)
+		r.Like(aubreigh, denver)
+		now = now.AddDate(2, 0, 0)
+		r.Like(chris, boulder)
+		r.Dislike(chris, denver)
+		now = now.AddDate(0, 0, 1)
+		r.Like(niko, boulder)
+
+		suggestions, err := r.GetSuggestions(niko)
+		if err != nil {
+			t.Errorf("%s: Error: %s", test.name, err)
+		}
+		if index := suggestions[denver.Id].Index; !test.check(index) {
+			t.Errorf("%s: Denver's index should be %s. It is %f", test.name, test.want, index)
+		}
+		prediction, err := r.Predict(niko, denver)
+		if err != nil {
+			t.Errorf("%s: Error: %s", test.name, err)
+		}
+		if !test.check(prediction.Index) || prediction.Neighbors != 2 {
+			t.Errorf("%s: Prediction for Denver should be %s from 2 neighbors. It is %+v", test.name, test.want, prediction)
+		}
+		r.Close()
+	}
+}
+
+func TestImplicitFeedback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	weights := map[recommender.EventType]float32{
+		recommender.View:     0.1,
+		recommender.Purchase: 1,
+		"share":              0.5,
+	}
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithEventWeights(weights))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	phoenix := recommender.NewItem("Phoenix")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Dislike(aubreigh, phoenix)
+
+	// Niko never rates Boulder, but views it twice and shares it
+	for _, eventType := range []recommender.EventType{recommender.View, recommender.View, "share"} {
+		if err := r.Record(niko, boulder, eventType, 1); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	if err := r.Record(niko, boulder, recommender.Click, 1); err == nil {
+		t.Errorf("Recording an event type without a weight should fail")
+	}
+	strength, err := r.GetImplicitStrength(niko, boulder)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if strength < 0.69 || strength > 0.71 {
+		t.Errorf("Niko's strength for Boulder should be 0.7. It is %f", strength)
+	}
+
+	// Aubreigh is Niko's neighbor through Boulder
+	similarities, err := r.GetSimilarUsers(niko, 0, recommender.SimilarUsersOptions{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(similarities) != 1 || similarities[0].User.Id != aubreigh.Id || similarities[0].Index != 1 {
+		t.Errorf("Aubreigh should be Niko's only neighbor, with index 1. Similarities are %v", similarities)
+	}
+
+	// Recording feedback only marks Niko's suggestions stale
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(suggestions) != 0 {
+		t.Errorf("Niko's suggestions should not be computed until requested. They are %v", suggestions)
+	}
+	if err := r.UpdateStaleSuggestions(); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	suggestions, err = r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[boulder.Id]; exists || len(suggestions) != 2 {
+		t.Errorf("There should be 2 suggestions, Denver and Phoenix. There are %d: %v", len(suggestions), suggestions)
+	}
+	if suggestions[denver.Id].Index <= 0 || suggestions[phoenix.Id].Index >= 0 {
+		t.Errorf("Denver should be suggested and Phoenix should not. Suggestions are %v", suggestions)
+	}
+
+	// Niko's implicit like counts toward predictions for Aubreigh, but with
+	// less confidence than an explicit like would
+	prediction, err := r.Predict(aubreigh, boulder)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if prediction.Neighbors != 1 || prediction.Index != 1 || prediction.Confidence >= 0.5 {
+		t.Errorf("Boulder should be predicted at 1 from Niko's implicit like, with confidence below 0.5. Prediction is %+v", prediction)
+	}
+}
+
+func TestHide(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+	phoenix := recommender.NewItem("Phoenix")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(aubreigh, phoenix)
+	r.Like(niko, boulder)
+
+	// Hiding Denver removes it from Niko's suggestions, but not Niko's
+	// similarity to Aubreigh
+	if err := r.Hide(niko, denver); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[phoenix.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("There should be 1 suggestion, Phoenix. There are %d: %v", len(suggestions), suggestions)
+	}
+	hidden, err := r.GetHiddenItems(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := hidden[denver.Id]; !exists || len(hidden) != 1 {
+		t.Errorf("There should be 1 hidden item, Denver. There are %d: %v", len(hidden), hidden)
+	}
+	similarity, err := r.GetSimilarity(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if similarity[aubreigh.Id].Overlap != 1 {
+		t.Errorf("Niko and Aubreigh should share 1 item. They share %d", similarity[aubreigh.Id].Overlap)
+	}
+
+	// Recomputed suggestions stay hidden
+	if err := r.UpdateSuggestions(niko); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be 0 problems. There are %d: %v", len(report.Problems), report.Problems)
+	}
+
+	// Unhiding brings Denver back
+	if err := r.Unhide(niko, denver); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	suggestions, err = r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[denver.Id]; !exists || len(suggestions) != 2 {
+		t.Errorf("There should be 2 suggestions, Denver and Phoenix. There are %d: %v", len(suggestions), suggestions)
+	}
+}
+
+func TestImpressions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	suppression := recommender.Suppression{After: 3, Penalty: 1}
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithSuppression(suppression))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	boulder := recommender.NewItem("Boulder")
+	denver := recommender.NewItem("Denver")
+
+	r.Like(aubreigh, boulder)
+	r.Like(aubreigh, denver)
+	r.Like(niko, boulder)
+
+	// Denver is shown three times and ignored
+	for i := 0; i < 3; i++ {
+		if err := r.RecordImpression(niko, denver); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if index := suggestions[denver.Id].Index; index != 0 {
+		t.Errorf("Denver should be demoted to 0. It is %f", index)
+	}
+
+	// A click ends the suppression
+	if err := r.RecordClick(niko, denver); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	suggestions, err = r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if index := suggestions[denver.Id].Index; index != 1 {
+		t.Errorf("Denver should be back at 1. It is %f", index)
+	}
+
+	r.RecordImpression(aubreigh, denver)
+	engagement, err := r.GetEngagement(denver)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if engagement.Impressions != 4 || engagement.Clicks != 1 || engagement.ClickThroughRate != 0.25 || engagement.Item.Name != "Denver" {
+		t.Errorf("Denver should have 4 impressions, 1 click and a 0.25 click-through rate. It has %+v", engagement)
+	}
+}
+
+func TestStaleItemCopies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithCodec(recommender.JSONCodec))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	portland := recommender.NewItem("Portland")
+	portland.Attributes = map[string]string{"state": "Oregon"}
+	if err := r.SaveItem(portland); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+
+	// A caller's stale copy is neither merged into nor changed
+	stale := &recommender.Item{Id: portland.Id, Attributes: map[string]string{"color": "red"}}
+	engagement, err := r.GetEngagement(stale)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if fmt.Sprint(engagement.Item.Attributes) != "map[state:Oregon]" {
+		t.Errorf("Portland's attributes should be the stored ones. They are %v", engagement.Item.Attributes)
+	}
+	if fmt.Sprint(stale.Attributes) != "map[color:red]" {
+		t.Errorf("The caller's attributes should be unchanged. They are %v", stale.Attributes)
+	}
+
+	// Deactivating through a stale copy keeps the stored attributes
+	if err := r.DeactivateItem(stale); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if item, err := r.GetItem(portland.Id); err != nil || !item.Inactive || fmt.Sprint(item.Attributes) != "map[state:Oregon]" {
+		t.Errorf("Portland should be inactive with its stored attributes. It is %+v, error %v", item, err)
+	}
+	if items, _ := r.GetItemsByName("Portland"); len(items) != 1 {
+		t.Errorf("Portland should still be found by name. Items are %v", items)
+	}
+
+	// Deactivating an item never stored indexes it
+	salem := recommender.NewExternalItem("OR-SLM", "Salem")
+	if err := r.DeactivateItem(salem); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if item, err := r.GetItemByExternalId("OR-SLM"); err != nil || !item.Inactive {
+		t.Errorf("Salem should be found, inactive, by external ID. It is %+v, error %v", item, err)
+	}
+	if items, _ := r.GetItemsByName("Salem"); len(items) != 1 {
+		t.Errorf("Salem should be found by name. Items are %v", items)
+	}
+}
+
+func TestTopSuggestions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	chris := recommender.NewUser("Chris Cole")
+
+	city := func(name, state string) *recommender.Item {
+		item := recommender.NewItem(name)
+		item.Attributes = map[string]string{"state": state}
+		return item
+	}
+	chicago := city("Chicago", "Illinois")
+	boulder := city("Boulder", "Colorado")
+	denver := city("Denver", "Colorado")
+	aspen := city("Aspen", "Colorado")
+	phoenix := city("Phoenix", "Arizona")
+
+	// Colorado is the most relevant, but Phoenix is the most different
+	for _, item := range []*recommender.Item{chicago, boulder, denver, aspen, phoenix} {
+		r.Like(aubreigh, item)
+	}
+	for _, item := range []*recommender.Item{chicago, boulder, denver, aspen} {
+		r.Like(chris, item)
+	}
+	r.Dislike(chris, phoenix)
+	r.Like(niko, chicago)
+
+	list, err := r.GetTopSuggestions(niko, 2, recommender.Diversity{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(list.Suggestions) != 2 || list.Suggestions[0].Item.Attributes["state"] != "Colorado" || list.Suggestions[1].Item.Attributes["state"] != "Colorado" {
+		t.Errorf("The top 2 suggestions should be in Colorado. They are %v", list.Suggestions)
+	}
+	if list.Diversity != 0 {
+		t.Errorf("Diversity should be 0. It is %f", list.Diversity)
+	}
+
+	list, err = r.GetTopSuggestions(niko, 2, recommender.Diversity{Tradeoff: 0.7})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(list.Suggestions) != 2 || list.Suggestions[0].Item.Attributes["state"] != "Colorado" || list.Suggestions[1].Item.Id != phoenix.Id {
+		t.Errorf("The top 2 suggestions should be a city in Colorado, then Phoenix. They are %v", list.Suggestions)
+	}
+	if list.Diversity != 1 {
+		t.Errorf("Diversity should be 1. It is %f", list.Diversity)
+	}
+
+	list, err = r.GetTopSuggestions(niko, 0, recommender.Diversity{Tradeoff: 0.7})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(list.Suggestions) != 4 {
+		t.Errorf("There should be 4 suggestions. There are %d: %v", len(list.Suggestions), list.Suggestions)
+	}
+}
+
+func TestRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	city := func(name, state string) *recommender.Item {
+		item := recommender.NewItem(name)
+		item.Attributes = map[string]string{"state": state}
+		return item
+	}
+	chicago := city("Chicago", "Illinois")
+	boulder := city("Boulder", "Colorado")
+	denver := city("Denver", "Colorado")
+	aspen := city("Aspen", "Colorado")
+	phoenix := city("Phoenix", "Arizona")
+	tucson := city("Tucson", "Arizona")
+	r.SaveItem(tucson)
+
+	for _, item := range []*recommender.Item{chicago, boulder, denver, aspen, phoenix} {
+		r.Like(aubreigh, item)
+	}
+	r.Like(niko, chicago)
+
+	rules := []*recommender.Rule{
+		{Kind: recommender.Exclude, Match: recommender.Match{ItemId: aspen.Id}},
+		{Kind: recommender.Bury, Match: recommender.Match{Attribute: "state", Value: "Arizona"}, Amount: 0.5},
+		{Kind: recommender.Boost, Match: recommender.Match{ItemId: denver.Id}, Amount: 0.25},
+		{Kind: recommender.Cap, Attribute: "state", Limit: 1},
+		{Kind: recommender.Pin, Match: recommender.Match{ItemId: tucson.Id}, Position: 1},
+	}
+	for _, rule := range rules {
+		if err := r.SaveRule(rule); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	if err := r.SaveRule(&recommender.Rule{Kind: "shuffle"}); err == nil {
+		t.Errorf("Saving a rule of unknown kind should fail")
+	}
+	stored, err := r.GetRules()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(stored) != 5 {
+		t.Errorf("There should be 5 rules. There are %d: %v", len(stored), stored)
+	}
+
+	// Aspen is excluded, Phoenix buried and Denver boosted
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[aspen.Id]; exists || len(suggestions) != 3 {
+		t.Errorf("There should be 3 suggestions, without Aspen. There are %d: %v", len(suggestions), suggestions)
+	}
+	if suggestions[phoenix.Id].Index != 0.5 || suggestions[denver.Id].Index != 1.25 || suggestions[boulder.Id].Index != 1 {
+		t.Errorf("Phoenix should be at 0.5, Denver at 1.25 and Boulder at 1. Suggestions are %v", suggestions)
+	}
+
+	// One city per state, with Tucson pinned second; Tucson counts toward
+	// the cap on Arizona, so Phoenix is left out
+	list, err := r.GetTopSuggestions(niko, 0, recommender.Diversity{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	var names []string
+	for _, suggestion := range list.Suggestions {
+		names = append(names, suggestion.Item.Name)
+	}
+	if fmt.Sprint(names) != "[Denver Tucson]" {
+		t.Errorf("Top suggestions should be [Denver Tucson]. They are %v", names)
+	}
+
+	// Pins of rated or excluded items are not placed
+	for _, item := range []*recommender.Item{chicago, aspen} {
+		if err := r.SaveRule(&recommender.Rule{Kind: recommender.Pin, Match: recommender.Match{ItemId: item.Id}}); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	list, err = r.GetTopSuggestions(niko, 0, recommender.Diversity{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	for _, suggestion := range list.Suggestions {
+		if suggestion.Item.Id == chicago.Id || suggestion.Item.Id == aspen.Id {
+			t.Errorf("Neither Chicago, which Niko rated, nor Aspen, which is excluded, should be pinned. Top suggestions are %v", list.Suggestions)
+		}
+	}
+
+	// With more pins than room, the first by position are kept
+	if err := r.SaveRule(&recommender.Rule{Kind: recommender.Pin, Match: recommender.Match{ItemId: boulder.Id}, Position: 0}); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	list, err = r.GetTopSuggestions(niko, 1, recommender.Diversity{})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(list.Suggestions) != 1 || list.Suggestions[0].Item.Id != boulder.Id {
+		t.Errorf("The only top suggestion should be Boulder. They are %v", list.Suggestions)
+	}
+
+	// Without the rules, the raw suggestions return
+	if stored, err = r.GetRules(); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	for _, rule := range stored {
+		if err := r.DeleteRule(rule.Id); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	suggestions, err = r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(suggestions) != 4 {
+		t.Errorf("There should be 4 suggestions. There are %d: %v", len(suggestions), suggestions)
+	}
+}
+
+func TestQuerySuggestions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	city := func(name, state, region string) *recommender.Item {
+		item := recommender.NewItem(name)
+		item.Attributes = map[string]string{"state": state, "region": region}
+		return item
+	}
+	chicago := city("Chicago", "Illinois", "midwest")
+	boulder := city("Boulder", "Colorado", "west")
+	denver := city("Denver", "Colorado", "west")
+	aspen := city("Aspen", "Colorado", "west")
+	phoenix := city("Phoenix", "Arizona", "southwest")
+	tucson := city("Tucson", "Arizona", "southwest")
+
+	for _, item := range []*recommender.Item{chicago, boulder, denver, aspen, phoenix, tucson} {
+		r.Like(aubreigh, item)
+	}
+	r.Like(niko, chicago)
+
+	names := func(page *recommender.SuggestionPage) []string {
+		var names []string
+		for _, suggestion := range page.Suggestions {
+			names = append(names, suggestion.Item.Name)
+		}
+		return names
+	}
+
+	// Filtering happens before the limit, so the page is full
+	query := recommender.SuggestionQuery{
+		Filter: fmt.Sprintf(`state IN ("Colorado", Arizona) and not id = %q`, aspen.Id),
+		Limit:  2,
+	}
+	page, err := r.QuerySuggestions(niko, query)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if len(page.Suggestions) != 2 || page.Next == "" {
+		t.Errorf("There should be 2 suggestions and a next page. There are %v, next %q", names(page), page.Next)
+	}
+	for _, suggestion := range page.Suggestions {
+		if suggestion.Item.Attributes["state"] == "Illinois" || suggestion.Item.Id == aspen.Id {
+			t.Errorf("%s should not match the filter", suggestion.Item.Name)
+		}
+	}
+
+	// Paging through every suggestion visits each once
+	seen := make(map[string]bool)
+	query = recommender.SuggestionQuery{Filter: `region != midwest or (state = "Illinois")`, Limit: 2}
+	for pages := 0; pages < 10; pages++ {
+		page, err := r.QuerySuggestions(niko, query)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+			break
+		}
+		for _, suggestion := range page.Suggestions {
+			if seen[suggestion.Item.Id] {
+				t.Errorf("%s should be returned once", suggestion.Item.Name)
+			}
+			seen[suggestion.Item.Id] = true
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Cursor = page.Next
+	}
+	if len(seen) != 5 {
+		t.Errorf("There should be 5 suggestions across pages. There are %d", len(seen))
+	}
+
+	for _, filter := range []string{`state =`, `state = "Colorado" and`, `(state = x`, `state ~ x`, `id in ("a" "b")`, `state = "open`} {
+		if _, err := r.QuerySuggestions(niko, recommender.SuggestionQuery{Filter: filter}); err == nil {
+			t.Errorf("Filter %s should not parse", filter)
+		}
+	}
+	// Bare words may hold any letters
+	page, err = r.QuerySuggestions(niko, recommender.SuggestionQuery{Filter: `state != Aràbia and region != Ñuble`})
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	} else if len(page.Suggestions) != 5 {
+		t.Errorf("There should be 5 suggestions. There are %v", names(page))
+	}
+	if _, err := r.QuerySuggestions(niko, recommender.SuggestionQuery{Cursor: "!"}); err == nil {
+		t.Errorf("An invalid cursor should be rejected")
+	}
+
+	// Caps and pins apply as in GetTopSuggestions, across pages
+	for _, rule := range []*recommender.Rule{
+		{Kind: recommender.Cap, Attribute: "state", Limit: 1},
+		{Kind: recommender.Pin, Match: recommender.Match{ItemId: tucson.Id}},
+	} {
+		if err := r.SaveRule(rule); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	var ranked []string
+	query = recommender.SuggestionQuery{Filter: `region != midwest`, Limit: 1}
+	for pages := 0; pages < 10; pages++ {
+		page, err := r.QuerySuggestions(niko, query)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+			break
+		}
+		for _, suggestion := range page.Suggestions {
+			ranked = append(ranked, suggestion.Item.Attributes["state"]+":"+suggestion.Item.Name)
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Cursor = page.Next
+	}
+	if len(ranked) != 2 || ranked[0] != "Arizona:Tucson" || !strings.HasPrefix(ranked[1], "Colorado:") {
+		t.Errorf("There should be Tucson, then one Colorado city. There are %v", ranked)
+	}
+}
+
+func TestItemLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithClock(func() time.Time { return now }))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+	chicago := recommender.NewItem("Chicago, Illinois")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	denver := recommender.NewItem("Denver, Colorado")
+	aspen := recommender.NewItem("Aspen, Colorado")
+	phoenix := recommender.NewItem("Phoenix, Arizona")
+
+	for _, item := range []*recommender.Item{chicago, boulder, denver, aspen, phoenix} {
+		r.Like(aubreigh, item)
+	}
+	r.Like(niko, chicago)
+	r.Hide(niko, phoenix)
+
+	// Aspen is only available in winter, and Phoenix until spring
+	aspen.AvailableFrom = time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)
+	phoenix.AvailableUntil = time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, item := range []*recommender.Item{aspen, phoenix} {
+		if err := r.SaveItem(item); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+	if err := r.DeactivateItem(denver); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	suggestions, err := r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[boulder.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("Boulder should be the only suggestion. Suggestions are %v", suggestions)
+	}
+
+	// Denver still counts towards similarity
+	similar, err := r.GetSimilarItems(boulder, 0)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	found := false
+	for _, similarity := range similar {
+		found = found || similarity.Item.Id == denver.Id
+	}
+	if !found {
+		t.Errorf("Denver should still be similar to Boulder. Similar items are %v", similar)
+	}
+
+	// Once winter comes, Aspen is suggested
+	now = time.Date(2018, 12, 24, 0, 0, 0, 0, time.UTC)
+	suggestions, err = r.GetSuggestions(niko)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, exists := suggestions[aspen.Id]; !exists || len(suggestions) != 2 {
+		t.Errorf("Boulder and Aspen should be suggested. Suggestions are %v", suggestions)
+	}
+
+	// Deleting Boulder removes every trace of it
+	if err := r.Like(niko, boulder); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if err := r.DeleteItem(boulder); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if users, _ := r.GetUsersWhoRated(boulder); len(users) != 0 {
+		t.Errorf("No user should have rated Boulder. Users are %v", users)
+	}
+	if items, _ := r.GetLikedItems(aubreigh); len(items) != 4 {
+		t.Errorf("Aubreigh should like 4 items. Items are %v", items)
+	}
+	similar, err = r.GetSimilarItems(chicago, 0)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	for _, similarity := range similar {
+		if similarity.Item.Id == boulder.Id {
+			t.Errorf("Boulder should not be similar to anything")
+		}
+	}
+	report, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !report.OK() {
+		t.Errorf("There should be no problems after deleting an item. There are %v", report.Problems)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	chris := recommender.NewUser("Chris Kovacevic")
+
+	chicago := recommender.NewItem("Chicago, Illinois")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	denver := recommender.NewItem("Denver, Colorado")
+	phoenix := recommender.NewItem("Phoenix, Arizona")
+
+	r.Like(aubreigh, chicago)
+	r.Like(aubreigh, boulder)
+	r.Dislike(aubreigh, phoenix)
+	r.Record(aubreigh, denver, recommender.View, 1)
+	r.Hide(aubreigh, denver)
+	r.RecordImpression(aubreigh, boulder)
+	r.Like(niko, chicago)
+	r.Like(chris, phoenix)
+
+	suggestions, _ := r.GetSuggestions(niko)
+	if _, exists := suggestions[boulder.Id]; !exists {
+		t.Errorf("Boulder should be suggested to Niko before Aubreigh is deleted. Suggestions are %v", suggestions)
+	}
+
+	report, err := r.DeleteUser(aubreigh)
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if report.Deleted["user"] != 1 || report.Deleted["userLikes"] != 2 || report.Deleted["userDislikes"] != 1 || report.Deleted["ratingLog"] != 3 || report.Deleted["userImplicit"] != 1 || report.Deleted["hidden"] != 1 || report.Deleted["impressions"] != 1 {
+		t.Errorf("The report should count every deleted entry. It is %+v", report)
+	}
+	if fmt.Sprint(report.Recomputed) != fmt.Sprint(sortedIds(niko.Id, chris.Id)) {
+		t.Errorf("Niko's and Chris's suggestions should be recomputed. Recomputed are %v", report.Recomputed)
+	}
+
+	// Nothing of Aubreigh remains
+	suggestions, _ = r.GetSuggestions(niko)
+	if len(suggestions) != 0 {
+		t.Errorf("Niko should have no suggestions. Suggestions are %v", suggestions)
+	}
+	if users, _ := r.GetUsersWhoRated(chicago); len(users) != 1 {
+		t.Errorf("Only Niko should have rated Chicago. Users are %v", users)
+	}
+	if similarity, _ := r.GetSimilarity(niko); len(similarity) != 0 {
+		t.Errorf("Niko should be similar to no one. Similarity is %v", similarity)
+	}
+	history, _ := r.GetItemHistory(chicago, time.Time{}, time.Now().Add(time.Hour))
+	if len(history) != 1 || history[0].UserId != niko.Id {
+		t.Errorf("Only Niko's rating of Chicago should be in its history. History is %v", history)
+	}
+	if strength, _ := r.GetImplicitStrength(aubreigh, denver); strength != 0 {
+		t.Errorf("Aubreigh's implicit feedback should be erased. Strength is %v", strength)
+	}
+	users, _ := r.GetUsers(0, 10)
+	if len(users) != 2 {
+		t.Errorf("There should be 2 users. There are %v", users)
+	}
+	check, err := r.Check()
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !check.OK() {
+		t.Errorf("There should be no problems after deleting a user. There are %v", check.Problems)
+	}
+}
+
+func sortedIds(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMergeUsers(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	tick := func() {
+		now = now.Add(time.Hour)
+	}
+
+	chicago := recommender.NewItem("Chicago, Illinois")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	denver := recommender.NewItem("Denver, Colorado")
+	phoenix := recommender.NewItem("Phoenix, Arizona")
+
+	for policy, expected := range map[recommender.MergePolicy]string{
+		recommender.NewestWins: "map[Boulder:1 Chicago:-1 Denver:-1 Phoenix:1]",
+		recommender.KeepTarget: "map[Boulder:1 Chicago:1 Denver:-1 Phoenix:1]",
+		recommender.KeepSource: "map[Boulder:1 Chicago:-1 Denver:1 Phoenix:1]",
+	} {
+		path := filepath.Join(t.TempDir(), "recommender.db")
+		r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithClock(clock))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		niko := recommender.NewUser("Niko Kovacevic")
+		visitor := recommender.NewUser("")
+		aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+
+		// Niko likes Chicago and dislikes Denver; as a visitor, Niko later
+		// dislikes Chicago but had liked Denver before
+		r.Like(aubreigh, chicago)
+		r.Like(aubreigh, phoenix)
+		r.Like(niko, boulder)
+		tick()
+		r.Like(visitor, denver)
+		tick()
+		r.Like(niko, chicago)
+		r.Dislike(niko, denver)
+		tick()
+		r.Dislike(visitor, chicago)
+		r.Like(visitor, phoenix)
+		visited := now
+		r.Record(visitor, phoenix, recommender.View, 2)
+		r.Hide(visitor, boulder)
+		tick()
+
+		if err := r.MergeUsers(visitor, niko, policy); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		ratings, err := r.GetRatings(niko)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		scores := make(map[string]int)
+		for _, rating := range ratings {
+			scores[rating.Item.Name[:strings.Index(rating.Item.Name, ",")]] = int(rating.Score)
+		}
+		if fmt.Sprint(scores) != expected {
+			t.Errorf("Policy %d should leave Niko's ratings at %s. They are %v", policy, expected, scores)
+		}
+		// Moved ratings keep the time the visitor made them
+		if rated := ratings[phoenix.Id].Time; !rated.Equal(visited) {
+			t.Errorf("Niko's like of Phoenix should date from %s. It dates from %s", visited, rated)
+		}
+
+		// The visitor is gone, and their hidden items and feedback are Niko's
+		if ratings, _ := r.GetRatings(visitor); len(ratings) != 0 {
+			t.Errorf("The visitor should have no ratings. They have %v", ratings)
+		}
+		if hidden, _ := r.GetHiddenItems(niko); len(hidden) != 1 {
+			t.Errorf("Niko should have hidden Boulder. Hidden items are %v", hidden)
+		}
+		if strength, _ := r.GetImplicitStrength(niko, phoenix); strength <= 0 {
+			t.Errorf("Niko should have the visitor's implicit feedback about Phoenix")
+		}
+		report, err := r.Check()
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if !report.OK() {
+			t.Errorf("There should be no problems after merging users. There are %v", report.Problems)
+		}
+		r.Close()
+	}
+	r, err := recommender.NewRecommender(recommender.WithPath(filepath.Join(t.TempDir(), "recommender.db")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.MergeUsers(recommender.NewUser(""), recommender.NewUser(""), recommender.MergePolicy(7)); err == nil {
+		t.Errorf("Merging with an unknown policy should fail")
+	}
+}
+
+func TestExternalIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	niko := recommender.NewExternalUser("account-17", "Niko Kovacevic")
+	if again := recommender.NewExternalUser("account-17", "Niko"); again.Id != niko.Id {
+		t.Errorf("The same external ID should yield the same user ID. %s != %s", again.Id, niko.Id)
+	}
+	if other := recommender.NewExternalUser("account-18", "Niko Kovacevic"); other.Id == niko.Id {
+		t.Errorf("Different external IDs should yield different user IDs")
+	}
+	boulder := recommender.NewExternalItem("SKU-80302", "Boulder, Colorado")
+	denver := recommender.NewItem("Denver, Colorado")
+	r.Like(niko, boulder)
+	r.Like(niko, denver)
+
+	user, err := r.GetUserByExternalId("account-17")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	} else if user.Id != niko.Id || user.ExternalId != "account-17" {
+		t.Errorf("The user with external ID account-17 should be Niko. It is %+v", user)
+	}
+	item, err := r.GetItemByExternalId("SKU-80302")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	} else if item.Id != boulder.Id {
+		t.Errorf("The item with external ID SKU-80302 should be Boulder. It is %v", item)
+	}
+	if users, _ := r.GetUsersByName("Niko Kovacevic"); len(users) != 1 {
+		t.Errorf("There should be 1 user named Niko Kovacevic. There are %v", users)
+	}
+
+	// Renaming an item moves it in the name index
+	denver.Name = "Denver, CO"
+	denver.ExternalId = "SKU-80202"
+	if err := r.SaveItem(denver); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if items, _ := r.GetItemsByName("Denver, Colorado"); len(items) != 0 {
+		t.Errorf("No item should be named Denver, Colorado. There are %v", items)
+	}
+	if items, _ := r.GetItemsByName("Denver, CO"); len(items) != 1 {
+		t.Errorf("Denver should be named Denver, CO. Items are %v", items)
+	}
+	if item, _ := r.GetItemByExternalId("SKU-80202"); item == nil || item.Id != denver.Id {
+		t.Errorf("The item with external ID SKU-80202 should be Denver. It is %v", item)
+	}
+	boulder.ExternalId = "SKU-80202"
+	if err := r.SaveItem(boulder); err == nil {
+		t.Errorf("Saving an item with another item's external ID should fail")
+	}
+
+	// Missing users and items are reported as such
+	if _, err := r.GetUser(recommender.NewUser("").Id); err != recommender.ErrUserNotFound {
+		t.Errorf("A missing user should be ErrUserNotFound. Error is %v", err)
+	}
+	if _, err := r.GetItemByExternalId("SKU-0"); err != recommender.ErrItemNotFound {
+		t.Errorf("A missing item should be ErrItemNotFound. Error is %v", err)
+	}
+	if _, err := r.DeleteUser(niko); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, err := r.GetUserByExternalId("account-17"); err != recommender.ErrUserNotFound {
+		t.Errorf("A deleted user should be ErrUserNotFound. Error is %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	r.Like(niko, boulder)
+
+	if _, err := r.GetUser(recommender.NewUser("").Id); !errors.Is(err, recommender.ErrUserNotFound) {
+		t.Errorf("A missing user should be ErrUserNotFound. Error is %v", err)
+	}
+	if _, err := r.GetItem(recommender.NewItem("").Id); !errors.Is(err, recommender.ErrItemNotFound) {
+		t.Errorf("A missing item should be ErrItemNotFound. Error is %v", err)
+	}
+	if _, err := r.QuerySuggestions(niko, recommender.SuggestionQuery{Filter: "state ="}); !errors.Is(err, recommender.ErrInvalidInput) {
+		t.Errorf("A malformed filter should be ErrInvalidInput. Error is %v", err)
+	}
+	if err := r.SaveRule(&recommender.Rule{Kind: "shuffle"}); !errors.Is(err, recommender.ErrInvalidInput) {
+		t.Errorf("An unknown rule kind should be ErrInvalidInput. Error is %v", err)
+	}
+	if err := r.Record(niko, boulder, "share", 1); !errors.Is(err, recommender.ErrInvalidInput) {
+		t.Errorf("An unknown event type should be ErrInvalidInput. Error is %v", err)
+	}
+
+	// Operations on a closed recommender fail alike
+	if err := r.Close(); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if err := r.Like(niko, boulder); !errors.Is(err, recommender.ErrClosed) {
+		t.Errorf("Rating after closing should be ErrClosed. Error is %v", err)
+	}
+	if _, err := r.GetSuggestions(niko); !errors.Is(err, recommender.ErrClosed) {
+		t.Errorf("Reading after closing should be ErrClosed. Error is %v", err)
+	}
+	for name, read := range map[string]func() error{
+		"GetRatings":          func() error { _, err := r.GetRatings(niko); return err },
+		"GetUsersWhoRated":    func() error { _, err := r.GetUsersWhoRated(boulder); return err },
+		"GetSimilarity":       func() error { _, err := r.GetSimilarity(niko); return err },
+		"GetSimilarUsers":     func() error { _, err := r.GetSimilarUsers(niko, 0, recommender.SimilarUsersOptions{}); return err },
+		"GetUserByExternalId": func() error { _, err := r.GetUserByExternalId("niko"); return err },
+	} {
+		if err := read(); !errors.Is(err, recommender.ErrClosed) {
+			t.Errorf("%s after closing should be ErrClosed. Error is %v", name, err)
+		}
+	}
+
+	// Failures of the database itself are storage errors
+	_, err = recommender.NewRecommender(recommender.WithPath(filepath.Join(path, "missing", "recommender.db")))
+	var storage *recommender.StorageError
+	if !errors.As(err, &storage) {
+		t.Errorf("Opening an impossible path should be a *StorageError. Error is %v", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	r, err := recommender.NewRecommender(recommender.WithPath(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cities, err := r.Tenant("cities")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	movies, err := r.Tenant("movies", recommender.WithSuppression(recommender.Suppression{After: 1, Penalty: 1}))
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, err := r.Tenant(""); !errors.Is(err, recommender.ErrInvalidInput) {
+		t.Errorf("A tenant without a name should be ErrInvalidInput. Error is %v", err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	chicago := recommender.NewItem("Chicago, Illinois")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	casablanca := recommender.NewItem("Casablanca")
+	vertigo := recommender.NewItem("Vertigo")
+
+	for _, item := range []*recommender.Item{chicago, boulder} {
+		cities.Like(aubreigh, item)
+	}
+	cities.Like(niko, chicago)
+	for _, item := range []*recommender.Item{casablanca, vertigo} {
+		movies.Like(aubreigh, item)
+	}
+	movies.Like(niko, casablanca)
+
+	// Each tenant sees only its own data
+	suggestions, _ := cities.GetSuggestions(niko)
+	if _, exists := suggestions[boulder.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("Boulder should be Niko's only city suggestion. Suggestions are %v", suggestions)
+	}
+	suggestions, _ = movies.GetSuggestions(niko)
+	if _, exists := suggestions[vertigo.Id]; !exists || len(suggestions) != 1 {
+		t.Errorf("Vertigo should be Niko's only movie suggestion. Suggestions are %v", suggestions)
+	}
+	if ratings, _ := r.GetRatings(niko); len(ratings) != 0 {
+		t.Errorf("The default tenant should have no ratings. There are %v", ratings)
+	}
+
+	// Each tenant has its own configuration
+	cities.RecordImpression(niko, boulder)
+	movies.RecordImpression(niko, vertigo)
+	if suggestions, _ := cities.GetSuggestions(niko); suggestions[boulder.Id].Index != 1 {
+		t.Errorf("Boulder should not be demoted. Suggestions are %v", suggestions)
+	}
+	if suggestions, _ := movies.GetSuggestions(niko); suggestions[vertigo.Id].Index != 0 {
+		t.Errorf("Vertigo should be demoted. Suggestions are %v", suggestions)
+	}
+
+	// Export writes only the tenant's data
+	var buf strings.Builder
+	if err := cities.Export(&buf); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if !strings.Contains(buf.String(), boulder.Id) || strings.Contains(buf.String(), vertigo.Id) {
+		t.Errorf("The export of cities should hold Boulder and not Vertigo. It is %s", buf.String())
+	}
+
+	// Deleting a tenant leaves the others alone
+	if err := r.DeleteTenant("movies"); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if _, err := movies.GetSuggestions(niko); !errors.Is(err, recommender.ErrTenantNotFound) {
+		t.Errorf("A deleted tenant should be ErrTenantNotFound. Error is %v", err)
+	}
+	if err := r.DeleteTenant("movies"); !errors.Is(err, recommender.ErrTenantNotFound) {
+		t.Errorf("Deleting a missing tenant should be ErrTenantNotFound. Error is %v", err)
+	}
+	if tenants, _ := r.Tenants(); fmt.Sprint(tenants) != "[cities]" {
+		t.Errorf("Only cities should be left. Tenants are %v", tenants)
+	}
+	cities.Close()
+	r.Close()
+
+	// Changing the codec re-encodes every tenant
+	r, err = recommender.NewRecommender(recommender.WithPath(path), recommender.WithCodec(recommender.JSONCodec))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	cities, err = r.Tenant("cities")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if items, err := cities.GetLikedItems(aubreigh); err != nil || len(items) != 2 {
+		t.Errorf("Aubreigh should like 2 cities. Items are %v, error %v", items, err)
+	}
+	if item, err := cities.GetItem(boulder.Id); err != nil || item.Name != boulder.Name {
+		t.Errorf("Boulder should be readable after re-encoding. Item is %v, error %v", item, err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommender.db")
+	var buf strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	r, err := recommender.NewRecommender(recommender.WithPath(path), recommender.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	niko := recommender.NewUser("Niko Kovacevic")
+	aubreigh := recommender.NewUser("Aubreigh Brunschwig")
+	chicago := recommender.NewItem("Chicago, Illinois")
+	boulder := recommender.NewItem("Boulder, Colorado")
+	r.Like(niko, chicago)
+	r.Like(aubreigh, chicago)
+	r.Like(aubreigh, boulder)
+
+	// events lists the logged events with the given message
+	events := func(msg string) []map[string]interface{} {
+		var found []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("Cannot decode %q: %s", line, err)
+			}
+			if event["msg"] == msg {
+				found = append(found, event)
+			}
+		}
+		return found
+	}
+
+	if written := events("rating written"); len(written) != 3 || written[0]["level"] != "DEBUG" || written[0]["user"] != niko.Id || written[0]["item"] != chicago.Id {
+		t.Errorf("Each rating should be logged. Events are %v", written)
+	}
+	if updated := events("suggestions updated"); len(updated) != 3 || updated[2]["user"] != aubreigh.Id || updated[2]["duration"] == nil {
+		t.Errorf("Each recomputation should be logged with its duration. Events are %v", updated)
+	}
+
+	// Tenants log to the same logger, with the tenant's name
+	cities, err := r.Tenant("cities")
+	if err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	cities.Like(niko, boulder)
+	if written := events("rating written"); len(written) != 4 || written[3]["tenant"] != "cities" {
+		t.Errorf("A tenant's rating should be logged with its name. Events are %v", written)
+	}
+	r.Close()
+
+	// Remove Boulder behind the Recommender's back, leaving a dangling like
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("item")).Delete([]byte(boulder.Id))
+	}); err != nil {
+		log.Fatal(err)
+	}
+	db.Close()
+
+	buf.Reset()
+	r, err = recommender.NewRecommender(recommender.WithPath(path), recommender.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+	items, _ := r.GetLikedItems(aubreigh)
+	if _, exists := items[chicago.Id]; !exists || len(items) != 1 {
+		t.Errorf("Aubreigh should like only Chicago. Items are %v", items)
+	}
+	if missing := events("missing item"); len(missing) != 1 || missing[0]["level"] != "WARN" || missing[0]["item"] != boulder.Id {
+		t.Errorf("The missing item should be logged. Events are %v", missing)
+	}
+	r.Close()
+}
@@ -0,0 +1,187 @@
+package recommender
+
+import (
+	"fmt"
+	"sort"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// RuleKind is the operation a Rule performs on suggestions.
+type RuleKind string
+
+const (
+	// Pin places the item with ID Match.ItemId at Position in
+	// GetTopSuggestions, whether or not it was suggested, unless the user
+	// has hidden or rated it, it is unavailable, or an Exclude rule matches
+	// it: Exclude takes precedence. Pinned items count toward Cap rules.
+	Pin RuleKind = "pin"
+	// Boost adds Amount to the index of matched items.
+	Boost RuleKind = "boost"
+	// Bury subtracts Amount from the index of matched items.
+	Bury RuleKind = "bury"
+	// Exclude removes matched items.
+	Exclude RuleKind = "exclude"
+	// Cap allows at most Limit items per value of Attribute in
+	// GetTopSuggestions.
+	Cap RuleKind = "cap"
+)
+
+// Match selects items by ID, or by the value of an attribute. The zero value
+// matches every item.
+type Match struct {
+	ItemId    string `json:"itemId,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Value     string `json:"value,omitempty"`
+	// Negate selects the items that would otherwise not match.
+	Negate bool `json:"negate,omitempty"`
+}
+
+// matches reports whether the item is selected.
+func (m Match) matches(item *Item) bool {
+	matched := true
+	if m.ItemId != "" && item.Id != m.ItemId {
+		matched = false
+	}
+	if m.Attribute != "" && item.Attributes[m.Attribute] != m.Value {
+		matched = false
+	}
+	return matched != m.Negate
+}
+
+// Rule is a merchandising rule, applied to suggestions when they are
+// retrieved. Rules are stored in the database, so they apply to every
+// Recommender using it.
+type Rule struct {
+	Id       string          `json:"id"`
+	Kind     RuleKind        `json:"kind"`
+	Match    Match           `json:"match"`
+	Position int             `json:"position,omitempty"`
+	Amount   SuggestionIndex `json:"amount,omitempty"`
+	// Attribute and Limit configure Cap rules.
+	Attribute string `json:"attribute,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// String represents a Rule as a string
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %+v", r.Kind, r.Match)
+}
+
+// SaveRule inserts or replaces the given Rule. A Rule without an ID is given
+// one.
+func (r *Recommender) SaveRule(rule *Rule) error {
+	switch rule.Kind {
+	case Pin, Boost, Bury, Exclude, Cap:
+	default:
+		return invalidInput("unknown rule kind %q", rule.Kind)
+	}
+	if rule.Id == "" {
+		rule.Id = uuid.NewV4().String()
+	}
+	return r.update(func(tx namespace) error {
+		data, err := r.codec.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(ruleBucketName)).Put([]byte(rule.Id), data)
+	})
+}
+
+// DeleteRule deletes the Rule with the given ID, if any.
+func (r *Recommender) DeleteRule(id string) error {
+	return r.update(func(tx namespace) error {
+		return tx.Bucket([]byte(ruleBucketName)).Delete([]byte(id))
+	})
+}
+
+// GetRules retrieves every Rule, ordered by ID.
+func (r *Recommender) GetRules() ([]Rule, error) {
+	var rules ruleSet
+	if err := r.view(func(tx namespace) error {
+		var err error
+		rules, err = r.getRules(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ruleSet is the set of rules in effect.
+type ruleSet []Rule
+
+// getRules reads every Rule within the given transaction.
+func (r *Recommender) getRules(tx namespace) (ruleSet, error) {
+	var rules ruleSet
+	cur := tx.Bucket([]byte(ruleBucketName)).Cursor()
+	for key, val := cur.First(); key != nil; key, val = cur.Next() {
+		var rule Rule
+		if err := r.codec.Unmarshal(val, &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply returns the suggestion's adjusted index, and whether the suggestion
+// is kept at all.
+func (rules ruleSet) apply(suggestion Suggestion) (SuggestionIndex, bool) {
+	index := suggestion.Index
+	for _, rule := range rules {
+		if !rule.Match.matches(&suggestion.Item) {
+			continue
+		}
+		switch rule.Kind {
+		case Exclude:
+			return 0, false
+		case Boost:
+			index += rule.Amount
+		case Bury:
+			index -= rule.Amount
+		}
+	}
+	return index, true
+}
+
+// capped reports whether adding the item would exceed a Cap rule, given the
+// items already picked.
+func (rules ruleSet) capped(item *Item, picked []Suggestion) bool {
+	for _, rule := range rules {
+		if rule.Kind != Cap || !rule.Match.matches(item) {
+			continue
+		}
+		value, exists := item.Attributes[rule.Attribute]
+		if !exists {
+			continue
+		}
+		count := 0
+		for _, suggestion := range picked {
+			if suggestion.Item.Attributes[rule.Attribute] == value {
+				count++
+			}
+		}
+		if count >= rule.Limit {
+			return true
+		}
+	}
+	return false
+}
+
+// pins returns the Pin rules, by position.
+func (rules ruleSet) pins() []Rule {
+	var pins []Rule
+	for _, rule := range rules {
+		if rule.Kind == Pin && rule.Match.ItemId != "" {
+			pins = append(pins, rule)
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Position != pins[j].Position {
+			return pins[i].Position < pins[j].Position
+		}
+		return pins[i].Id < pins[j].Id
+	})
+	return pins
+}
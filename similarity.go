@@ -1,8 +1,103 @@
 package recommender
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
 type SimilarityIndex float32
 
 type Similarity struct {
-	User  User            `json:"user"`
-	Index SimilarityIndex `json:"index"`
+	User    User            `json:"user"`
+	Index   SimilarityIndex `json:"index"`
+	Overlap int             `json:"overlap"`
+}
+
+// SimilarUsersOptions controls which neighbors GetSimilarUsers returns and how
+// their indices are weighted.
+type SimilarUsersOptions struct {
+	// MinOverlap excludes neighbors who share fewer co-rated items.
+	MinOverlap int
+	// SignificanceThreshold is the number of co-rated items at which an index
+	// is fully trusted. Indices backed by fewer co-rated items are shrunk
+	// toward zero in proportion to the overlap. Zero disables weighting.
+	SignificanceThreshold int
+}
+
+type ItemSimilarity struct {
+	Item     Item            `json:"item"`
+	Index    SimilarityIndex `json:"index"`
+	CoRaters int             `json:"coRaters"`
+}
+
+// similarityRecord is the stored form of a pairwise similarity. Agree and
+// Disagree count the co-rated entries on which the pair gave the same score
+// and different scores, respectively.
+type similarityRecord struct {
+	Agree    int `json:"agree"`
+	Disagree int `json:"disagree"`
+}
+
+// overlap returns the number of co-rated entries behind the record.
+func (s similarityRecord) overlap() int {
+	return s.Agree + s.Disagree
+}
+
+// index returns the similarity index, from -1 to 1, described by the record.
+func (s similarityRecord) index() SimilarityIndex {
+	if s.overlap() == 0 {
+		return 0
+	}
+	return SimilarityIndex(float32(s.Agree-s.Disagree) / float32(s.overlap()))
+}
+
+// count adds delta to the agree or disagree count for a pair of scores given
+// to the same entry. A zero score means unrated, and counts nothing.
+func (s similarityRecord) count(score1, score2 Score, delta int) similarityRecord {
+	if score1 == 0 || score2 == 0 {
+		return s
+	}
+	if score1 == score2 {
+		s.Agree += delta
+	} else {
+		s.Disagree += delta
+	}
+	return s
+}
+
+// UnmarshalJSON decodes a record. Earlier versions stored a bare index
+// instead of a record. A bare index carries no counts, and incremental updates
+// on top of it would be wrong, so it is refused; upgrading the file rebuilds
+// the records from the ratings.
+func (s *similarityRecord) UnmarshalJSON(data []byte) error {
+	var index SimilarityIndex
+	if err := json.Unmarshal(data, &index); err == nil {
+		return fmt.Errorf("similarity record holds a bare index %v from an earlier version", index)
+	}
+	type record similarityRecord
+	return json.Unmarshal(data, (*record)(s))
+}
+
+// significance shrinks index toward zero when overlap is below threshold.
+func significance(index SimilarityIndex, overlap, threshold int) SimilarityIndex {
+	if threshold <= 0 || overlap >= threshold {
+		return index
+	}
+	return index * SimilarityIndex(overlap) / SimilarityIndex(threshold)
+}
+
+// sortSimilarities ranks similarities from most to least similar, breaking
+// ties by overlap and then by user ID.
+func sortSimilarities(similarities []Similarity) {
+	sort.Slice(similarities, func(i, j int) bool {
+		a, b := similarities[i], similarities[j]
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		if a.Overlap != b.Overlap {
+			return a.Overlap > b.Overlap
+		}
+		return a.User.Id < b.User.Id
+	})
 }
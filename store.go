@@ -0,0 +1,292 @@
+package recommender
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// Sets of IDs, similarity records and suggestions are stored one nested
+// bucket per user or item, keyed by the counterpart ID. For example, the items
+// a user likes are the keys of userLikes/<user ID>, and the similarity record
+// of two users is the value at userSimilarity/<user ID>/<other user ID>. Adds
+// and removes are therefore single Put and Delete calls.
+
+// namespace holds the buckets of one tenant: the transaction itself for the
+// default tenant, whose buckets are at the top level, or the tenant's bucket
+// under tenants/<name>. Both *bolt.Tx and *bolt.Bucket satisfy it.
+type namespace interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// nestedBucket returns the bucket stored under key in the named top-level
+// bucket, or nil if there is none.
+func nestedBucket(tx namespace, bucketName, key string) *bolt.Bucket {
+	return tx.Bucket([]byte(bucketName)).Bucket([]byte(key))
+}
+
+// putNested stores value under member in the bucket nested under key in the
+// named top-level bucket, creating the nested bucket if necessary.
+func putNested(tx namespace, bucketName, key, member string, value []byte) error {
+	bucket, err := tx.Bucket([]byte(bucketName)).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(member), value)
+}
+
+// deleteNested removes member from the bucket nested under key in the named
+// top-level bucket. The nested bucket is removed once it is empty.
+func deleteNested(tx namespace, bucketName, key, member string) error {
+	bucket := nestedBucket(tx, bucketName, key)
+	if bucket == nil {
+		return nil
+	}
+	if err := bucket.Delete([]byte(member)); err != nil {
+		return err
+	}
+	if first, _ := bucket.Cursor().First(); first == nil {
+		return tx.Bucket([]byte(bucketName)).DeleteBucket([]byte(key))
+	}
+	return nil
+}
+
+// deleteAllNested removes the bucket nested under key in the named top-level
+// bucket, along with everything in it.
+func deleteAllNested(tx namespace, bucketName, key string) error {
+	if nestedBucket(tx, bucketName, key) == nil {
+		return nil
+	}
+	return tx.Bucket([]byte(bucketName)).DeleteBucket([]byte(key))
+}
+
+// deleteMemberEverywhere removes member from every bucket nested in the named
+// top-level bucket.
+func deleteMemberEverywhere(tx namespace, bucketName, member string) error {
+	var keys []string
+	cur := tx.Bucket([]byte(bucketName)).Cursor()
+	for key, val := cur.First(); key != nil; key, val = cur.Next() {
+		if val == nil {
+			keys = append(keys, string(key))
+		}
+	}
+	for _, key := range keys {
+		if err := deleteNested(tx, bucketName, key, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addToSet adds member to the set stored under key.
+func addToSet(tx namespace, bucketName, key, member string) error {
+	return putNested(tx, bucketName, key, member, []byte{})
+}
+
+// inSet reports whether member is in the set stored under key.
+func inSet(tx namespace, bucketName, key, member string) bool {
+	bucket := nestedBucket(tx, bucketName, key)
+	return bucket != nil && bucket.Get([]byte(member)) != nil
+}
+
+// setMembers returns the members of the set stored under key.
+func setMembers(tx namespace, bucketName, key string) map[string]bool {
+	members := make(map[string]bool)
+	if bucket := nestedBucket(tx, bucketName, key); bucket != nil {
+		cur := bucket.Cursor()
+		for member, _ := cur.First(); member != nil; member, _ = cur.Next() {
+			members[string(member)] = true
+		}
+	}
+	return members
+}
+
+// getRecord reads the similarity record of key and member, if there is one.
+func (r *Recommender) getRecord(tx namespace, bucketName, key, member string) (similarityRecord, error) {
+	var record similarityRecord
+	bucket := nestedBucket(tx, bucketName, key)
+	if bucket == nil {
+		return record, nil
+	}
+	if data := bucket.Get([]byte(member)); data != nil {
+		if err := r.codec.Unmarshal(data, &record); err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// putRecord writes the similarity record of key and member in both
+// directions, removing it if it has no overlap.
+func (r *Recommender) putRecord(tx namespace, bucketName, key, member string, record similarityRecord) error {
+	if record.overlap() == 0 {
+		if err := deleteNested(tx, bucketName, key, member); err != nil {
+			return err
+		}
+		return deleteNested(tx, bucketName, member, key)
+	}
+	data, err := r.codec.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := putNested(tx, bucketName, key, member, data); err != nil {
+		return err
+	}
+	return putNested(tx, bucketName, member, key, data)
+}
+
+// getRecords reads every similarity record stored under key, keyed by the
+// counterpart ID.
+func (r *Recommender) getRecords(tx namespace, bucketName, key string) (map[string]similarityRecord, error) {
+	records := make(map[string]similarityRecord)
+	bucket := nestedBucket(tx, bucketName, key)
+	if bucket == nil {
+		return records, nil
+	}
+	cur := bucket.Cursor()
+	for member, data := cur.First(); member != nil; member, data = cur.Next() {
+		var record similarityRecord
+		if err := r.codec.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		records[string(member)] = record
+	}
+	return records, nil
+}
+
+// migrateNestedBuckets converts buckets written by earlier versions, which
+// stored each set or suggestion map as one JSON value per key, into nested
+// buckets. Keys already holding nested buckets are left alone, and missing
+// buckets are skipped. Similarity records are then rebuilt from the ratings.
+func migrateNestedBuckets(tx *bolt.Tx) error {
+	for _, bucketName := range []string{
+		userLikesBucketName,
+		itemLikesBucketName,
+		userDislikesBucketName,
+		itemDislikesBucketName,
+		suggestionBucketName,
+	} {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			continue
+		}
+
+		// Collect legacy values first, since the bucket cannot be
+		// modified while its cursor is in use
+		legacy := make(map[string][]byte)
+		cur := bucket.Cursor()
+		for key, val := cur.First(); key != nil; key, val = cur.Next() {
+			if val != nil {
+				legacy[string(key)] = append([]byte(nil), val...)
+			}
+		}
+
+		for key, data := range legacy {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+			entries, err := legacyEntries(bucketName, data)
+			if err != nil {
+				return err
+			}
+			for member, value := range entries {
+				if err := putNested(tx, bucketName, key, member, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return rebuildSimilarity(tx)
+}
+
+// rebuildSimilarity recomputes the similarity records of a file from before
+// they held counts. Earlier versions stored a bare index for each pair, from
+// which the counts cannot be recovered, and incremental updates need them.
+// Values are encoded as JSON, the only codec of the time.
+func rebuildSimilarity(tx *bolt.Tx) error {
+	// The user side of each rating is authoritative, and pairs both liked
+	// and disliked are left out, as in Repair
+	ratings := make(map[string]map[string]Score)
+	conflicts := make(map[[2]string]bool)
+	for bucketName, score := range map[string]Score{userLikesBucketName: like, userDislikesBucketName: dislike} {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			continue
+		}
+		if err := bucket.ForEach(func(key, _ []byte) error {
+			userId := string(key)
+			for itemId := range setMembers(tx, bucketName, userId) {
+				if ratings[userId] == nil {
+					ratings[userId] = make(map[string]Score)
+				}
+				if _, rated := ratings[userId][itemId]; rated {
+					conflicts[[2]string{userId, itemId}] = true
+				}
+				ratings[userId][itemId] = score
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	for pair := range conflicts {
+		delete(ratings[pair[0]], pair[1])
+	}
+
+	expectedUsers, expectedItems := expectedSimilarity(ratings)
+	for bucketName, values := range map[string]map[string]map[string]similarityRecord{
+		userSimilarityBucketName: expectedUsers,
+		itemSimilarityBucketName: expectedItems,
+	} {
+		encoded := make(map[string]map[string][]byte)
+		for key, records := range values {
+			encoded[key] = make(map[string][]byte)
+			for id, record := range records {
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				encoded[key][id] = data
+			}
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+			return err
+		}
+		if err := replaceBucket(tx, bucketName, encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyEntries decodes a legacy JSON value from the named bucket into the
+// entries of its nested bucket.
+func legacyEntries(bucketName string, data []byte) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	switch bucketName {
+	case suggestionBucketName:
+		suggestionMap := make(map[string]Suggestion)
+		if err := json.Unmarshal(data, &suggestionMap); err != nil {
+			return nil, err
+		}
+		for id, suggestion := range suggestionMap {
+			value, err := json.Marshal(suggestion.Index)
+			if err != nil {
+				return nil, err
+			}
+			entries[id] = value
+		}
+	default:
+		ids := make(map[string]bool)
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			entries[id] = []byte{}
+		}
+	}
+	return entries, nil
+}
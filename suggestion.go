@@ -1,8 +1,109 @@
 package recommender
 
+import "sort"
+
 type SuggestionIndex float32
 
 type Suggestion struct {
 	Item  Item            `json:"item"`
 	Index SuggestionIndex `json:"index"`
 }
+
+// Prediction estimates how a user would score a single item. Confidence grows
+// from 0, with no contributing neighbors, toward 1 as more strongly correlated
+// neighbors contribute.
+type Prediction struct {
+	Item       Item            `json:"item"`
+	Index      SuggestionIndex `json:"index"`
+	Confidence float32         `json:"confidence"`
+	Neighbors  int             `json:"neighbors"`
+}
+
+// Neighborhood controls which of a user's neighbors contribute to the user's
+// suggestions. The zero value selects every neighbor.
+type Neighborhood struct {
+	// K caps the neighborhood at the K neighbors with the strongest indices.
+	// Zero means no cap.
+	K int
+	// MinSimilarity excludes neighbors whose index is closer to zero.
+	MinSimilarity SimilarityIndex
+	// MinOverlap excludes neighbors who share fewer co-rated items.
+	MinOverlap int
+	// ExcludeNegative excludes negatively correlated neighbors, whose
+	// dislikes would otherwise count in an item's favor.
+	ExcludeNegative bool
+}
+
+// selectNeighbors returns the similarities admitted by the neighborhood,
+// strongest first.
+func (n Neighborhood) selectNeighbors(similarityMap map[string]Similarity) []Similarity {
+	var neighbors []Similarity
+	for _, similarity := range similarityMap {
+		if similarity.Overlap < n.MinOverlap {
+			continue
+		}
+		if n.ExcludeNegative && similarity.Index < 0 {
+			continue
+		}
+		if abs(similarity.Index) < n.MinSimilarity {
+			continue
+		}
+		neighbors = append(neighbors, similarity)
+	}
+
+	sort.Slice(neighbors, func(i, j int) bool {
+		a, b := abs(neighbors[i].Index), abs(neighbors[j].Index)
+		if a != b {
+			return a > b
+		}
+		return neighbors[i].User.Id < neighbors[j].User.Id
+	})
+	if n.K > 0 && len(neighbors) > n.K {
+		neighbors = neighbors[:n.K]
+	}
+
+	return neighbors
+}
+
+// tally accumulates neighbors' scores for a single item.
+type tally struct {
+	zL, zD, total, weight float32
+	neighbors             int
+}
+
+// add counts a neighbor's score, weighted by the neighbor's index and by the
+// score's weight, which is below one for decayed ratings and implicit likes.
+// A score of weight one counts as one neighbor.
+func (t *tally) add(score Score, index SimilarityIndex, weight float32) {
+	switch score {
+	case like:
+		t.zL += float32(index) * weight
+	case dislike:
+		t.zD += float32(index) * weight
+	default:
+		return
+	}
+	t.total += weight
+	t.neighbors++
+	t.weight += float32(abs(index)) * weight
+}
+
+// index returns the suggestion index, (zL-zD)/total.
+func (t *tally) index() SuggestionIndex {
+	if t.total == 0 {
+		return 0
+	}
+	return SuggestionIndex((t.zL - t.zD) / t.total)
+}
+
+// confidence maps the summed strength of contributing neighbors onto [0, 1).
+func (t *tally) confidence() float32 {
+	return t.weight / (t.weight + 1)
+}
+
+func abs(index SimilarityIndex) SimilarityIndex {
+	if index < 0 {
+		return -index
+	}
+	return index
+}
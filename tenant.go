@@ -0,0 +1,213 @@
+package recommender
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Tenants keep independent catalogs in one file. The default tenant's
+// buckets are at the top level, as they were before tenants existed; every
+// other tenant's buckets are nested under tenants/<name>. The schema version
+// and codec are those of the file, so migrations must upgrade every tenant.
+
+// namespace returns the buckets of the Recommender's tenant.
+func (r *Recommender) namespace(tx *bolt.Tx) (namespace, error) {
+	if r.tenant == "" {
+		return tx, nil
+	}
+	bucket := tx.Bucket([]byte(tenantBucketName)).Bucket([]byte(r.tenant))
+	if bucket == nil {
+		return nil, ErrTenantNotFound
+	}
+	return bucket, nil
+}
+
+// Tenant returns a Recommender for the named tenant, creating the tenant if
+// it does not exist. It shares the file and codec of r, and is otherwise
+// configured by the given options alone, so that each tenant can have its
+// own neighborhood, decay, event weights and suppression. Without WithLogger,
+// it logs to the logger of r. WithPath and WithCodec are ignored. If r is
+// read-only, so is the tenant, and it must already exist.
+func (r *Recommender) Tenant(name string, opts ...Option) (*Recommender, error) {
+	if name == "" {
+		return nil, invalidInput("tenant name is empty")
+	}
+	t := &Recommender{clock: time.Now, eventWeights: defaultEventWeights, logger: r.logger.With("tenant", name)}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.db, t.path, t.codec, t.tenant, t.readOnly = r.db, r.path, r.codec, name, r.readOnly
+
+	if t.readOnly {
+		if err := t.view(func(namespace) error { return nil }); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if err := r.logStorageError(storageError(r.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket([]byte(tenantBucketName)).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		return createBuckets(bucket)
+	}))); err != nil {
+		return nil, err
+	}
+
+	// Recompute suggestions left stale by an interrupted rating
+	if err := t.recoverSuggestions(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Tenants lists the names of the tenants other than the default one.
+func (r *Recommender) Tenants() ([]string, error) {
+	var names []string
+	if err := r.logStorageError(storageError(r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tenantBucketName)).ForEach(func(name, _ []byte) error {
+			names = append(names, string(name))
+			return nil
+		})
+	}))); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// DeleteTenant deletes the named tenant and all of its data. Recommenders
+// for the tenant return ErrTenantNotFound afterwards.
+func (r *Recommender) DeleteTenant(name string) error {
+	return r.logStorageError(storageError(r.db.Update(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket([]byte(tenantBucketName))
+		if name == "" || tenants.Bucket([]byte(name)) == nil {
+			return ErrTenantNotFound
+		}
+		return tenants.DeleteBucket([]byte(name))
+	})))
+}
+
+// export is the document written by Export. Similarity records and
+// suggestions are left out, since they are derived from the rest.
+type export struct {
+	Tenant      string                `json:"tenant,omitempty"`
+	Users       []User                `json:"users"`
+	Items       []Item                `json:"items"`
+	Ratings     []RatingEvent         `json:"ratings"`
+	History     []RatingEvent         `json:"history"`
+	Implicit    []exportedImplicit    `json:"implicit"`
+	Hidden      []exportedPair        `json:"hidden"`
+	Impressions []exportedImpressions `json:"impressions"`
+	Rules       []Rule                `json:"rules"`
+}
+
+type exportedPair struct {
+	UserId string `json:"userId"`
+	ItemId string `json:"itemId"`
+}
+
+type exportedImplicit struct {
+	exportedPair
+	Strength float32 `json:"strength"`
+}
+
+type exportedImpressions struct {
+	exportedPair
+	impressionRecord
+}
+
+// Export writes the Recommender's tenant as a JSON document: its users,
+// items, current ratings with the time of their last change, rating history,
+// implicit preference strengths, hidden items, impressions and rules.
+func (r *Recommender) Export(w io.Writer) error {
+	doc := export{Tenant: r.tenant}
+	if err := r.view(func(tx namespace) error {
+		if err := tx.Bucket([]byte(userBucketName)).ForEach(func(_, data []byte) error {
+			var user User
+			if err := r.codec.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			doc.Users = append(doc.Users, user)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(itemBucketName)).ForEach(func(_, data []byte) error {
+			var item Item
+			if err := r.codec.Unmarshal(data, &item); err != nil {
+				return err
+			}
+			doc.Items = append(doc.Items, item)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(ratingLogBucketName)).ForEach(func(_, data []byte) error {
+			var event RatingEvent
+			if err := r.codec.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			doc.History = append(doc.History, event)
+			return nil
+		}); err != nil {
+			return err
+		}
+		var err error
+		if doc.Rules, err = r.getRules(tx); err != nil {
+			return err
+		}
+
+		for _, user := range doc.Users {
+			scores, err := scoresTx(tx, userLikesBucketName, userDislikesBucketName, user.Id)
+			if err != nil {
+				return err
+			}
+			times, err := r.ratingTimes(tx, user.Id)
+			if err != nil {
+				return err
+			}
+			for _, itemId := range sortedKeys(scores) {
+				doc.Ratings = append(doc.Ratings, RatingEvent{UserId: user.Id, ItemId: itemId, Score: scores[itemId], Time: times[itemId]})
+			}
+
+			strengths, err := r.implicitStrengths(tx, userImplicitBucketName, user.Id)
+			if err != nil {
+				return err
+			}
+			for _, itemId := range sortedKeys(strengths) {
+				doc.Implicit = append(doc.Implicit, exportedImplicit{exportedPair{user.Id, itemId}, strengths[itemId]})
+			}
+
+			for _, itemId := range sortedKeys(setMembers(tx, hiddenBucketName, user.Id)) {
+				doc.Hidden = append(doc.Hidden, exportedPair{user.Id, itemId})
+			}
+
+			for _, itemId := range sortedKeys(setMembers(tx, impressionBucketName, user.Id)) {
+				record, err := r.impressions(tx, user.Id, itemId)
+				if err != nil {
+					return err
+				}
+				doc.Impressions = append(doc.Impressions, exportedImpressions{exportedPair{user.Id, itemId}, record})
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// sortedKeys returns the keys of a map keyed by ID, in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
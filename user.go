@@ -10,13 +10,26 @@ type User struct {
 	Id      string            `json:"id"`
 	Name    string            `json:"name"`
 	Ratings map[string]Rating `json:"ratings"`
+	// ExternalId is the caller's own ID for the user, such as an account ID.
+	ExternalId string `json:"externalId,omitempty"`
 }
 
+// userNamespace is the namespace of the v5 UUIDs derived from external user
+// IDs.
+var userNamespace = uuid.NewV5(uuid.NamespaceURL, "github.com/nikovacevic/recommender/user")
+
 // NewUser creates and returns a new User
 func NewUser(name string) *User {
 	return &User{Id: uuid.NewV4().String(), Name: name}
 }
 
+// NewExternalUser creates and returns a User known to the caller by
+// externalId. Its ID is a v5 UUID derived from externalId, so the same
+// external ID always yields the same User ID.
+func NewExternalUser(externalId, name string) *User {
+	return &User{Id: uuid.NewV5(userNamespace, externalId).String(), Name: name, ExternalId: externalId}
+}
+
 // String represents a User as a string
 func (u User) String() string {
 	return fmt.Sprintf("%s", u.Name)